@@ -0,0 +1,117 @@
+package Abstractions
+
+import (
+	"io"
+	"time"
+
+	"../Common"
+)
+
+// AppendOnly refuses everything that deletes or moves files, for hosts that only hold
+// credentials to add files. Those credentials are what actually protects the backups,
+// this only fails early and clearly instead of halfway through a cleanup.
+type AppendOnly struct {
+	backend Common.Backend
+}
+
+func NewAppendOnly(backend Common.Backend) *AppendOnly {
+	return &AppendOnly{backend: backend}
+}
+
+func (this *AppendOnly) PutChunk(info *Common.ChunkInfo, reader io.Reader, wantedMD5 string) error {
+	return this.backend.PutChunk(info, reader, wantedMD5)
+}
+
+func (this *AppendOnly) StreamChunk(info *Common.ChunkInfo, reader io.Reader) (string, error) {
+	streamer, ok := this.backend.(Common.ChunkStreamer)
+	if !ok {
+		return "", Common.E_NO_STREAMING
+	}
+	return streamer.StreamChunk(info, reader)
+}
+
+func (this *AppendOnly) ListChunks(uuid string) ([]*Common.RemoteChunk, error) {
+	return this.backend.ListChunks(uuid)
+}
+
+func (this *AppendOnly) ChunkMD5(chunk *Common.RemoteChunk) (string, error) {
+	hasher, ok := this.backend.(Common.ChunkHasher)
+	if !ok {
+		return chunk.MD5, nil
+	}
+	return hasher.ChunkMD5(chunk)
+}
+
+func (this *AppendOnly) GetChunk(chunk *Common.RemoteChunk, writer io.Writer) (int64, error) {
+	return this.backend.GetChunk(chunk, writer)
+}
+
+// PutMetadata only stores metadata of new snapshots. Replacing it could strip the key
+// slots of a snapshot, which is left to the admin credentials.
+func (this *AppendOnly) PutMetadata(meta *Common.Metadata) error {
+	_, err := this.backend.GetMetadata(meta.Uuid)
+	if err == nil {
+		return Common.E_APPEND_ONLY
+	}
+	if err != Common.E_NO_METADATA {
+		return err
+	}
+	return this.backend.PutMetadata(meta)
+}
+
+func (this *AppendOnly) GetMetadata(uuid string) (*Common.Metadata, error) {
+	return this.backend.GetMetadata(uuid)
+}
+
+func (this *AppendOnly) ListMetadata(fileType string, subvolume string, callback func(*Common.Metadata)) error {
+	return this.backend.ListMetadata(fileType, subvolume, callback)
+}
+
+func (this *AppendOnly) GetLatest(subvolume string) (*Common.Snapshot, error) {
+	return this.backend.GetLatest(subvolume)
+}
+
+// SetLatest is allowed, as backups have to advance their pointer. Backends keep the
+// previous versions of it, if configured as described in the readme.
+func (this *AppendOnly) SetLatest(subvolume string, latest *Common.Snapshot) error {
+	return this.backend.SetLatest(subvolume, latest)
+}
+
+func (this *AppendOnly) ListUuids() ([]string, error) {
+	return this.backend.ListUuids()
+}
+
+func (this *AppendOnly) Delete(uuid string) error {
+	return Common.E_APPEND_ONLY
+}
+
+func (this *AppendOnly) Quarantine(uuid string) error {
+	return Common.E_APPEND_ONLY
+}
+
+func (this *AppendOnly) ListQuarantined() (map[string]time.Time, error) {
+	quarantiner, ok := this.backend.(Common.Quarantiner)
+	if !ok {
+		return nil, Common.E_NO_QUARANTINE
+	}
+	return quarantiner.ListQuarantined()
+}
+
+func (this *AppendOnly) RestoreQuarantined(uuid string) error {
+	return Common.E_APPEND_ONLY
+}
+
+func (this *AppendOnly) Purge(uuid string) error {
+	return Common.E_APPEND_ONLY
+}
+
+func (this *AppendOnly) ClassifyError(err error) *Common.ErrorClass {
+	if classifier, ok := this.backend.(Common.ErrorClassifier); ok {
+		return classifier.ClassifyError(err)
+	}
+	return nil
+}
+
+func (this *AppendOnly) Quota() (*Common.Quota, error) {
+	return this.backend.Quota()
+}
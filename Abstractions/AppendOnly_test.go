@@ -0,0 +1,42 @@
+package Abstractions
+
+import (
+	"testing"
+
+	"../Common"
+)
+
+func TestAppendOnly(t *testing.T) {
+	backend := NewAppendOnly(newLocalBackend(t))
+
+	meta := &Common.Metadata{Uuid: "u1", FileName: "tank/data@1", Subvolume: "tank/data", KeySlots: []Common.KeySlot{{Type: Common.KEY_SLOT_PASSPHRASE}}}
+	err := backend.PutMetadata(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A compromised host must not be able to strip the key slots
+	err = backend.PutMetadata(&Common.Metadata{Uuid: "u1", FileName: "tank/data@1", Subvolume: "tank/data"})
+	if err != Common.E_APPEND_ONLY {
+		t.Errorf("replacing metadata returned %v", err)
+	}
+	stored, err := backend.GetMetadata("u1")
+	if err != nil || len(stored.KeySlots) != 1 {
+		t.Errorf("metadata was changed to %+v, %v", stored, err)
+	}
+
+	err = backend.SetLatest("tank/data", &Common.Snapshot{Uuid: "u1", Filename: "tank/data@1"})
+	if err != nil {
+		t.Errorf("SetLatest returned %v", err)
+	}
+	for what, err := range map[string]error{
+		"Delete":             backend.Delete("u1"),
+		"Quarantine":         backend.Quarantine("u1"),
+		"RestoreQuarantined": backend.RestoreQuarantined("u1"),
+		"Purge":              backend.Purge("u1"),
+	} {
+		if err != Common.E_APPEND_ONLY {
+			t.Errorf("%s returned %v", what, err)
+		}
+	}
+}
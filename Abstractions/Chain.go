@@ -0,0 +1,217 @@
+package Abstractions
+
+import (
+	"../Common"
+	"github.com/prometheus/common/log"
+	"time"
+)
+
+// BuildChain walks from the latest snapshot of subvolume back to its full backup.
+// The returned chain is ordered from the full backup to the latest snapshot.
+// DiskSize is 0 for snapshots uploaded before it was stored as a property.
+func BuildChain(backend Common.Backend, subvolume string, print bool) []Common.SnapshotWithSize {
+	latestUploaded, err := backend.GetLatest(subvolume)
+	Common.PrintAndExitOnError(err, 1)
+
+	if latestUploaded == nil {
+		return []Common.SnapshotWithSize{}
+	}
+
+	latestUuid := latestUploaded.Uuid
+
+	// One listing instead of one lookup per snapshot. Snapshots missing from it,
+	// e.g. parents uploaded under another subvolume name, are looked up one by one.
+	listed := make(map[string]*Common.Metadata)
+	err = backend.ListMetadata("", subvolume, func(meta *Common.Metadata) {
+		listed[meta.Uuid] = meta
+	})
+	if err != nil {
+		log.Errorf("Could not list snapshots, looking them up one by one: %v", err)
+	}
+
+	var chain []Common.SnapshotWithSize
+
+	for true {
+		fs := listed[latestUuid]
+		if fs == nil {
+			fs, err = backend.GetMetadata(latestUuid)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		snap := Common.SnapshotWithSize{Uuid: fs.Uuid, Filename: fs.FileName, DownloadSize: fs.TotalSize, DiskSize: fs.TotalSizeIn}
+		if print {
+			log.Infof("snapshot: %s", fs.FileName)
+		}
+		chain = append([]Common.SnapshotWithSize{snap}, chain...)
+		if fs.Parent == "" {
+			break
+		}
+
+		// fetch parent on next iteration
+		latestUuid = fs.Parent
+	}
+
+	return chain
+}
+
+// Cleanup quarantines every snapshot in the backend that is not part of the chain of subvolume
+// and purges quarantined snapshots once grace has passed. Without a grace period, or if the
+// backend cannot quarantine, snapshots are deleted right away.
+// Every target of a Mirror is cleaned up on its own, as their chains may differ.
+func Cleanup(backend Common.Backend, subvolume string, grace time.Duration) {
+	if mirror, ok := backend.(*Mirror); ok {
+		for _, target := range mirror.active() {
+			log.Infof("Cleaning up '%s'...", target.Name)
+			Cleanup(target.Backend, subvolume, grace)
+		}
+		return
+	}
+
+	if _, ok := backend.(*AppendOnly); ok {
+		log.Errorf("Not cleaning up: %v", Common.E_APPEND_ONLY)
+		return
+	}
+
+	quarantiner, canQuarantine := backend.(Common.Quarantiner)
+
+	log.Infof("Backend Cleanup...")
+	log.Info("Builing restore chain...")
+	chain := BuildChain(backend, subvolume, false)
+	if len(chain) == 0 {
+		log.Errorf("No chain found for '%s'. Refusing to clean up.", subvolume)
+		return
+	}
+
+	log.Info("Retrieving list of snapshots...")
+	uuids, err := backend.ListUuids()
+	if err != nil {
+		log.Error(err)
+	}
+	log.Infof("Retrieved %d snapshots", len(uuids))
+
+	log.Info("Deleting files...")
+	var quarantined, deleted, failed int
+snapshots:
+	for _, uuid := range uuids {
+		if uuid == "" {
+			continue snapshots // Failsafe
+		}
+		for _, snap := range chain {
+			if snap.Uuid == uuid {
+				continue snapshots
+			}
+		}
+		if canQuarantine && grace > 0 {
+			log.Infof("Quarantining %s", uuid)
+			err = quarantiner.Quarantine(uuid)
+			if err != Common.E_NO_QUARANTINE {
+				if err != nil {
+					log.Errorf("Could not quarantine %s: %v", uuid, err)
+					failed++
+				} else {
+					quarantined++
+				}
+				continue snapshots
+			}
+		}
+		log.Infof("Deleting %s", uuid)
+		err := backend.Delete(uuid)
+		if err != nil {
+			log.Errorf("Could not delete %s: %v", uuid, err)
+			failed++
+		} else {
+			deleted++
+		}
+	}
+
+	var purged, kept int
+	if canQuarantine {
+		var purgeFailed int
+		purged, kept, purgeFailed = purge(quarantiner, grace)
+		failed += purgeFailed
+	}
+
+	summary := "Backend Cleanup done: %d quarantined, %d deleted, %d purged, %d kept in quarantine, %d failed"
+	if failed > 0 {
+		log.Errorf(summary, quarantined, deleted, purged, kept, failed)
+	} else {
+		log.Infof(summary, quarantined, deleted, purged, kept, failed)
+	}
+}
+
+// purge deletes the snapshots that have been quarantined for longer than grace. It returns
+// how many snapshots were purged, kept in quarantine and failed to purge.
+func purge(quarantiner Common.Quarantiner, grace time.Duration) (purged int, kept int, failed int) {
+	quarantined, err := quarantiner.ListQuarantined()
+	if err == Common.E_NO_QUARANTINE {
+		return
+	}
+	if err != nil {
+		log.Errorf("Could not list quarantined snapshots: %v", err)
+		failed++
+		return
+	}
+
+	for uuid, since := range quarantined {
+		if time.Since(since) < grace {
+			log.Infof("Keeping %s in quarantine until %s", uuid, since.Add(grace).Format(time.RFC3339))
+			kept++
+			continue
+		}
+		log.Infof("Purging %s", uuid)
+		err = quarantiner.Purge(uuid)
+		if err != nil {
+			log.Errorf("Could not purge %s: %v", uuid, err)
+			failed++
+		} else {
+			purged++
+		}
+	}
+	return
+}
+
+// RestoreQuarantined moves the quarantined snapshot uuid, or every quarantined snapshot for
+// "all", back into the backend. Every target of a Mirror is restored on its own.
+func RestoreQuarantined(backend Common.Backend, uuid string) error {
+	if mirror, ok := backend.(*Mirror); ok {
+		for _, target := range mirror.Targets {
+			log.Infof("Restoring quarantined snapshots of '%s'...", target.Name)
+			err := RestoreQuarantined(target.Backend, uuid)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	quarantiner, ok := backend.(Common.Quarantiner)
+	if !ok {
+		return Common.E_NO_QUARANTINE
+	}
+	quarantined, err := quarantiner.ListQuarantined()
+	if err != nil {
+		return err
+	}
+
+	var uuids []string
+	if uuid == "all" {
+		for quarantinedUuid := range quarantined {
+			uuids = append(uuids, quarantinedUuid)
+		}
+	} else if _, ok := quarantined[uuid]; ok {
+		uuids = append(uuids, uuid)
+	} else {
+		log.Warnf("%s is not quarantined", uuid)
+	}
+
+	for _, restored := range uuids {
+		log.Infof("Restoring %s", restored)
+		err = quarantiner.RestoreQuarantined(restored)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package Abstractions
+
+import (
+	"testing"
+	"time"
+)
+
+// failingQuarantiner holds quarantined snapshots in memory and fails to purge the ones in fail.
+type failingQuarantiner struct {
+	quarantined map[string]time.Time
+	fail        map[string]bool
+}
+
+func (this *failingQuarantiner) Quarantine(uuid string) error {
+	this.quarantined[uuid] = time.Now()
+	return nil
+}
+
+func (this *failingQuarantiner) ListQuarantined() (map[string]time.Time, error) {
+	return this.quarantined, nil
+}
+
+func (this *failingQuarantiner) RestoreQuarantined(uuid string) error {
+	delete(this.quarantined, uuid)
+	return nil
+}
+
+func (this *failingQuarantiner) Purge(uuid string) error {
+	if this.fail[uuid] {
+		return errBroken
+	}
+	delete(this.quarantined, uuid)
+	return nil
+}
+
+func TestPurgeCounts(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	quarantiner := &failingQuarantiner{
+		quarantined: map[string]time.Time{"old": old, "broken": old, "new": time.Now()},
+		fail:        map[string]bool{"broken": true},
+	}
+
+	purged, kept, failed := purge(quarantiner, time.Hour)
+	if purged != 1 || kept != 1 || failed != 1 {
+		t.Errorf("purge returned %d purged, %d kept, %d failed", purged, kept, failed)
+	}
+	if _, ok := quarantiner.quarantined["old"]; ok || len(quarantiner.quarantined) != 2 {
+		t.Errorf("left %v in quarantine", quarantiner.quarantined)
+	}
+}
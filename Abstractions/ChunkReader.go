@@ -0,0 +1,432 @@
+package Abstractions
+
+import (
+	"../Common"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"io"
+	"io/ioutil"
+	"os"
+	"github.com/prometheus/common/log"
+)
+
+const READ_CACHE_FILENAME = "OZBReadCache"
+
+var E_READER_CLOSED = errors.New("reader closed")
+var E_CHUNKS_MISSING = errors.New("some chunks are missing")
+var E_READ_TOO_SHORT = errors.New("data read from cache smaller than expected")
+var E_CHUNK_TOO_LONG = errors.New("chunk is larger than reported by the backend")
+
+// ChunkReader reads the chunks of a snapshot from the backend one after
+// another and presents them as one continuous stream.
+// The next `prefetch` chunks are downloaded into caches of their own in the
+// background, while the current one is read.
+// In streaming mode a chunk is passed on while it is downloaded, instead of being
+// staged in the cache first. It is verified once it was read completely, so a
+// corrupted chunk fails the whole download.
+type ChunkReader struct {
+	io.Reader
+	cache     *os.File
+	chunkPos  int64
+	Total     int64
+	chunk     uint
+	uuid      string
+	closed    bool
+	backend   Common.Backend
+	chunks    map[uint]*Common.RemoteChunk
+	chunkSize map[uint]int64
+	hitEOF    bool
+	streaming bool
+	stream    *io.PipeReader
+	prefetch  uint
+	caches    []*os.File
+	free      chan *os.File
+	ahead     map[uint]*prefetched
+	stop      chan struct{}
+}
+
+// prefetched is a chunk that is downloaded in the background.
+type prefetched struct {
+	cache *os.File
+	done  chan struct{}
+	// Why the download was given up on
+	err error
+}
+
+// skipWriter drops the first skip bytes, as they were passed on by an earlier attempt.
+type skipWriter struct {
+	writer    io.Writer
+	skip      int64
+	delivered *int64
+}
+
+func (this *skipWriter) Write(p []byte) (int, error) {
+	if this.skip >= int64(len(p)) {
+		this.skip -= int64(len(p))
+		return len(p), nil
+	}
+
+	skipped := int(this.skip)
+	this.skip = 0
+	n, err := this.writer.Write(p[skipped:])
+	*this.delivered += int64(n)
+	return skipped + n, err
+}
+
+func NewChunkReader(backend Common.Backend, meta *Common.Metadata, tmpBase string, streaming bool, prefetch uint) (*ChunkReader, error) {
+	reader := &ChunkReader{chunkPos: 0, chunk: 0, uuid: meta.Uuid, closed: false, backend: backend, chunkSize: make(map[uint]int64), chunks: make(map[uint]*Common.RemoteChunk), hitEOF: false, streaming: streaming, prefetch: prefetch, ahead: make(map[uint]*prefetched), stop: make(chan struct{})}
+
+	if streaming && prefetch > 0 {
+		log.Warnln("Streamed chunks are downloaded one at a time")
+	}
+	remoteChunks, err := backend.ListChunks(meta.Uuid)
+	if err != nil {
+		return nil, err
+	}
+	for _, remoteChunk := range remoteChunks {
+		reader.chunks[remoteChunk.Chunk] = remoteChunk
+		reader.chunkSize[remoteChunk.Chunk] = remoteChunk.Size
+	}
+
+	// Make sure we got all chunks available
+	var maxIndex uint = 0
+	for index := range reader.chunks {
+		if index > maxIndex {
+			maxIndex = index
+		}
+	}
+	if len(reader.chunks) != int(maxIndex+1) || uint(len(reader.chunks)) != meta.Chunks {
+		return nil, E_CHUNKS_MISSING
+	}
+
+	// Only created once the snapshot is known to be complete, so nothing is left to remove
+	// when it is not
+	if !streaming {
+		// One cache for the chunk being read, and one for each chunk ahead of it
+		err = reader.createCaches(tmpBase, int(prefetch)+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = reader.download(0)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	log.Infof("Reading from chunk %d...", 0)
+
+	return reader, nil
+}
+
+func (this *ChunkReader) createCaches(tmpBase string, count int) error {
+	if tmpBase == "" {
+		stat, err := os.Stat("/dev/shm")
+		if err == nil && stat.IsDir() {
+			tmpBase = "/dev/shm"
+			log.Infoln( "Using shared memory as cache...")
+		}
+	}
+
+	err := os.MkdirAll(tmpBase, 0777)
+	if err != nil {
+		return err
+	}
+
+	this.free = make(chan *os.File, count)
+	for i := 0; i < count; i++ {
+		cache, err := ioutil.TempFile(tmpBase, READ_CACHE_FILENAME)
+		if err != nil {
+			this.removeCaches()
+			return err
+		}
+		this.caches = append(this.caches, cache)
+		this.free <- cache
+	}
+
+	return nil
+}
+
+func (this *ChunkReader) removeCaches() error {
+	var err error
+	for _, cache := range this.caches {
+		_ = cache.Close()
+		removeErr := os.Remove(cache.Name())
+		if removeErr != nil {
+			err = removeErr
+		}
+	}
+	return err
+}
+
+// fetch downloads a chunk into cache and verifies it against the MD5 reported by the backend.
+func (this *ChunkReader) fetch(chunk *Common.RemoteChunk, cache *os.File) (int64, error) {
+	_, err := cache.Seek(0, 0)
+	if err != nil {
+		return 0, err
+	}
+	err = cache.Truncate(0)
+	if err != nil {
+		return 0, err
+	}
+
+	hash := md5.New()
+	multiWriter := io.MultiWriter(cache, hash)
+
+	n, err := this.backend.GetChunk(chunk, Common.DownloadLimiter.Writer(multiWriter))
+	if err != nil {
+		return 0, err
+	}
+
+	writtenMD5 := fmt.Sprintf("%x", hash.Sum(nil))
+
+	// Empty MD5 = backend does not know it, disable verification.
+	// A chunk that is corrupted at rest does not get better by downloading it again.
+	if chunk.MD5 != "" && writtenMD5 != chunk.MD5 {
+		return 0, Common.Permanent(Common.E_BACKEND_HASH_MISMATCH)
+	}
+
+	err = cache.Sync()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = cache.Seek(0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// startFetch downloads a chunk into a free cache in the background.
+func (this *ChunkReader) startFetch(index uint) {
+	fetching := &prefetched{cache: <-this.free, done: make(chan struct{})}
+	this.ahead[index] = fetching
+
+	go func() {
+		defer close(fetching.done)
+		log.Infof( "Downloading chunk %d...", index)
+		var size int64
+		fetching.err = Common.DefaultRetry.Do(fmt.Sprintf("Download of chunk %d", index), func() error {
+			select {
+			case <-this.stop:
+				return Common.Permanent(E_READER_CLOSED)
+			default:
+			}
+			var err error
+			size, err = this.fetch(this.chunks[index], fetching.cache)
+			return err
+		}, this.backend)
+		if fetching.err == nil {
+			log.Infof("Downloaded chunk %d (%s)", index, humanize.IBytes(uint64(size)))
+		}
+	}()
+}
+
+// startStream pipes a chunk from the backend into this.stream. A download that fails
+// is started over, skipping what was already passed on.
+func (this *ChunkReader) startStream(index uint) {
+	reader, writer := io.Pipe()
+	this.stream = reader
+	this.chunkPos = 0
+
+	chunk := this.chunks[index]
+	log.Infof("Streaming chunk %d...", index)
+	go func() {
+		var delivered int64
+		err := Common.DefaultRetry.Do(fmt.Sprintf("Download of chunk %d", index), func() error {
+			hash := md5.New()
+			skipper := &skipWriter{writer: writer, skip: delivered, delivered: &delivered}
+			_, err := this.backend.GetChunk(chunk, Common.DownloadLimiter.Writer(io.MultiWriter(hash, skipper)))
+			if err == io.ErrClosedPipe {
+				// The reader was closed
+				return Common.Permanent(err)
+			}
+			if err != nil {
+				log.Warnf("Download of chunk %d failed after %s", index, humanize.IBytes(uint64(delivered)))
+				return err
+			}
+
+			// Empty MD5 = backend does not know it, disable verification.
+			// What was passed on cannot be taken back, so this is not retried.
+			if chunk.MD5 != "" && fmt.Sprintf("%x", hash.Sum(nil)) != chunk.MD5 {
+				return Common.Permanent(Common.E_BACKEND_HASH_MISMATCH)
+			}
+			return nil
+		}, this.backend)
+		writer.CloseWithError(err)
+	}()
+}
+
+// finishStream checks that the current chunk ends where it is expected to and matches its MD5.
+func (this *ChunkReader) finishStream() error {
+	buff := make([]byte, 1)
+	for {
+		n, err := this.stream.Read(buff)
+		if n != 0 {
+			return E_CHUNK_TOO_LONG
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (this *ChunkReader) download(chunk uint) error {
+	if this.streaming {
+		this.startStream(chunk)
+		return nil
+	}
+
+	// The previous chunk was read completely
+	if this.cache != nil {
+		this.free <- this.cache
+		this.cache = nil
+	}
+
+	for next := chunk; next <= chunk+this.prefetch && int(next) < len(this.chunks); next++ {
+		if this.ahead[next] == nil {
+			this.startFetch(next)
+		}
+	}
+
+	fetching := this.ahead[chunk]
+	<-fetching.done
+	delete(this.ahead, chunk)
+
+	this.cache = fetching.cache
+	this.chunkPos = 0
+
+	return fetching.err
+}
+
+func (this *ChunkReader) readIt(p []byte) (int64, error) {
+	if this.streaming {
+		n, err := io.ReadFull(this.stream, p)
+		if err != nil {
+			return int64(this.chunkPos), err
+		}
+		return this.chunkPos + int64(n), nil
+	}
+
+	n, err := this.cache.Read(p)
+	if err != nil {
+		return int64(this.chunkPos), err
+	}
+	if n != len(p) {
+		return 0, E_READ_TOO_SHORT
+	}
+
+	curloc, err := this.cache.Seek(0, 1)
+	if err != nil {
+		return int64(this.chunkPos), err
+	}
+
+	return curloc, nil
+}
+
+func (this *ChunkReader) Read(p []byte) (int, error) {
+	if this.closed {
+		return 0, E_READER_CLOSED
+	}
+	if this.hitEOF {
+		return 0, io.EOF
+
+	}
+
+	availableToRead := this.chunkSize[this.chunk] - this.chunkPos
+	wantToRead := int64(len(p))
+
+	if wantToRead > availableToRead {
+		read1 := make([]byte, availableToRead)
+		if availableToRead != 0 {
+			currentLocation, err := this.readIt(read1)
+			if err != nil {
+				return 0, err
+			}
+			this.chunkPos = currentLocation
+		}
+		restToRead := wantToRead - availableToRead
+
+		if this.streaming {
+			err := this.finishStream()
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		lastChunk := int(this.chunk+1) == len(this.chunks)
+		if lastChunk {
+			copy(p, read1)
+			this.hitEOF = true
+			this.Total += int64(len(read1))
+			return len(read1), nil
+		}
+
+		err := this.download(this.chunk + 1)
+		if err != nil {
+			return 0, err
+		}
+		this.chunk++
+
+		log.Infof("Reading from chunk %d...", this.chunk)
+
+		if this.chunkSize[this.chunk] < restToRead {
+			restToRead = this.chunkSize[this.chunk]
+		}
+		read2 := make([]byte, restToRead)
+		currentLocation, err := this.readIt(read2)
+		if err != nil {
+			return 0, err
+		}
+		this.chunkPos = currentLocation
+
+		wholeRead := append(read1, read2...)
+		copy(p, wholeRead)
+		this.Total += availableToRead + restToRead
+		return int(availableToRead + restToRead), nil
+	} else {
+		buff := make([]byte, len(p))
+		currentLocation, err := this.readIt(buff)
+		if err != nil {
+			return 0, err
+		}
+		this.chunkPos = currentLocation
+
+		copy(p, buff)
+
+		this.Total += int64(len(p))
+		return len(p), nil
+	}
+}
+
+func (this *ChunkReader) Close() error {
+	if this.closed {
+		return nil
+	} // Ignore double closes
+
+	this.closed = true
+	close(this.stop)
+
+	if this.streaming {
+		this.stream.Close()
+		log.Infof("Finished stream after %s", humanize.IBytes(uint64(this.Total)))
+		return nil
+	}
+
+	// Downloads still running ahead fail on the closed caches and stop
+	err := this.removeCaches()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Finished stream after %s", humanize.IBytes(uint64(this.Total)))
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package Abstractions
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"../Common"
+	"../Local"
+)
+
+func TestChunkReaderCorruptChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ozbreader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend, err := Local.NewBackend(filepath.Join(dir, "backend"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("chunk at rest")
+	info := &Common.ChunkInfo{Uuid: "u1", FileName: "tank/data@1", IsData: true, Chunk: 0}
+	err = backend.PutChunk(info, bytes.NewReader(data), fmt.Sprintf("%x", md5.Sum(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same size, different content
+	err = ioutil.WriteFile(filepath.Join(dir, "backend", Common.ChunkFileName("u1", 0)), bytes.ToUpper(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, streaming := range []bool{false, true} {
+		start := time.Now()
+		reader, err := NewChunkReader(backend, &Common.Metadata{Uuid: "u1", Chunks: 1}, dir, streaming, 0)
+		if err == nil {
+			_, err = ioutil.ReadAll(reader)
+			reader.Close()
+		}
+		if err != Common.E_BACKEND_HASH_MISMATCH {
+			t.Errorf("reading a corrupted chunk (streaming %v) returned %v", streaming, err)
+		}
+		if time.Since(start) >= Common.DefaultRetry.Initial/2 {
+			t.Errorf("a corrupted chunk (streaming %v) was retried", streaming)
+		}
+	}
+}
+
+// No caches are left behind when the chunks of the snapshot cannot be listed or are missing
+func TestChunkReaderListingFails(t *testing.T) {
+	backend := newLocalBackend(t)
+	data := []byte("only chunk")
+	info := &Common.ChunkInfo{Uuid: "u1", FileName: "tank/data@1", IsData: true, Chunk: 0}
+	err := backend.PutChunk(info, bytes.NewReader(data), fmt.Sprintf("%x", md5.Sum(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, test := range map[string]struct {
+		backend Common.Backend
+		err     error
+	}{
+		"broken":  {&brokenBackend{Backend: backend}, errBroken},
+		"missing": {backend, E_CHUNKS_MISSING},
+	} {
+		dir := t.TempDir()
+		_, err = NewChunkReader(test.backend, &Common.Metadata{Uuid: "u1", Chunks: 2}, dir, false, 2)
+		if err != test.err {
+			t.Errorf("%s: NewChunkReader returned %v", name, err)
+		}
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("%s: left %d caches behind", name, len(entries))
+		}
+	}
+}
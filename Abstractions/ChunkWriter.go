@@ -0,0 +1,343 @@
+package Abstractions
+
+import (
+	"../Common"
+	"crypto/md5"
+	//"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"github.com/prometheus/common/log"
+
+)
+
+const WRITE_CACHE_FILENAME = "OZBWriteCache"
+
+var E_WRITER_CLOSED = errors.New("writer closed")
+
+// ChunkWriter splits everything written to it into chunks of cacheSize
+// and uploads each of them to the backend.
+// Up to `uploads` chunks are staged in caches at once. A full cache is uploaded in the
+// background while the next one is written, and writes block while all of them are in use.
+// In streaming mode a chunk is piped to the backend while it is written, instead of
+// being staged in the cache first. A chunk that failed to upload cannot be sent again
+// then, so the whole upload fails.
+type ChunkWriter struct {
+	io.WriteCloser
+	cache        *os.File
+	written      int
+	Total        uint64
+	cacheSize    int
+	Chunk        uint
+	fileNameBase string
+	backend      Common.Backend
+	closed       bool
+	meta         *Common.MetadataBase
+	hash         hash.Hash
+	streamer     Common.ChunkStreamer
+	pipe         *io.PipeWriter
+	stored       chan streamResult
+	caches       []*os.File
+	free         chan *os.File
+	pending      sync.WaitGroup
+	lock         sync.Mutex
+	failed       error
+}
+
+type streamResult struct {
+	md5 string
+	err error
+}
+
+func NewChunkWriter(backend Common.Backend, meta *Common.MetadataBase, cacheSize int, tmpBase string, streaming bool, uploads int) (*ChunkWriter, error) {
+	if streaming {
+		streamer, ok := backend.(Common.ChunkStreamer)
+		if !ok {
+			return nil, Common.E_NO_STREAMING
+		}
+		if uploads > 1 {
+			log.Warnln("Streamed chunks are uploaded one at a time")
+		}
+		return &ChunkWriter{written: 0, Chunk: 0, backend: backend, cacheSize: cacheSize, closed: false, meta: meta, hash: md5.New(), streamer: streamer}, nil
+	}
+
+	if tmpBase == "" {
+		stat, err := os.Stat("/dev/shm")
+		if err == nil && stat.IsDir() {
+			tmpBase = "/dev/shm"
+			log.Infoln( "Using shared memory as cache...")
+		}
+	}
+
+	err := os.MkdirAll(tmpBase, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	if uploads < 1 {
+		uploads = 1
+	}
+
+	writer := &ChunkWriter{written: 0, Chunk: 0, backend: backend, cacheSize: cacheSize, closed: false, meta: meta, hash: md5.New(), free: make(chan *os.File, uploads)}
+
+	for i := 0; i < uploads; i++ {
+		cache, err := ioutil.TempFile(tmpBase, WRITE_CACHE_FILENAME)
+		if err != nil {
+			writer.removeCaches()
+			return nil, err
+		}
+		writer.caches = append(writer.caches, cache)
+		writer.free <- cache
+	}
+	writer.cache = <-writer.free
+
+	return writer, nil
+}
+
+func (this *ChunkWriter) removeCaches() {
+	for _, cache := range this.caches {
+		_ = cache.Close()
+		_ = os.Remove(cache.Name())
+	}
+}
+
+func (this *ChunkWriter) fail(err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.failed == nil {
+		this.failed = err
+	}
+}
+
+// err returns why a background upload failed, if one did.
+func (this *ChunkWriter) err() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.failed
+}
+
+func (this *ChunkWriter) chunkInfo() *Common.ChunkInfo {
+	return &Common.ChunkInfo{Uuid: this.meta.Uuid, Encryption: this.meta.Encryption, Authentication: this.meta.Authentication, IsData: true, FileName: this.meta.FileName, Chunk: this.Chunk}
+}
+
+// startStream starts the upload of the current chunk, which is fed by writeSync.
+func (this *ChunkWriter) startStream() {
+	reader, writer := io.Pipe()
+	this.pipe = writer
+	this.stored = make(chan streamResult, 1)
+
+	info := this.chunkInfo()
+	stored := this.stored
+	log.Infof("Streaming chunk %d...", this.Chunk)
+	go func() {
+		storedMD5, err := this.streamer.StreamChunk(info, Common.UploadLimiter.Reader(reader))
+		// Unblocks writeSync if the backend stopped reading early
+		reader.CloseWithError(err)
+		stored <- streamResult{md5: storedMD5, err: err}
+	}()
+}
+
+// finishStream ends the current chunk and waits for the backend to store it.
+func (this *ChunkWriter) finishStream() error {
+	if this.pipe == nil {
+		// Chunks are uploaded even if they are empty, the same as from the cache
+		this.startStream()
+	}
+
+	this.pipe.Close()
+	result := <-this.stored
+	this.pipe = nil
+	if result.err != nil {
+		log.Errorf("Upload of chunk %d failed for a total of %s. %s", this.Chunk, humanize.IBytes(uint64(this.Total)+uint64(this.written)), result.err.Error())
+		return result.err
+	}
+
+	if result.md5 != fmt.Sprintf("%x", this.hash.Sum(nil)) {
+		return Common.E_BACKEND_HASH_MISMATCH
+	}
+
+	this.Total += uint64(this.written)
+	this.written = 0
+	log.Infof("Uploaded chunk %d for a total of %s.", this.Chunk, humanize.IBytes(uint64(this.Total)))
+	this.Chunk++
+	this.hash = md5.New()
+
+	return nil
+}
+
+func (this *ChunkWriter) upload() error {
+	if this.streamer != nil {
+		return this.finishStream()
+	}
+
+	err := this.cache.Sync()
+	if err != nil {
+		return err
+	}
+
+	fileHash := fmt.Sprintf("%x", this.hash.Sum(nil))
+	chunkInfo := this.chunkInfo()
+	cache := this.cache
+	size := this.written
+
+	// The chunk number is taken here, so the order does not depend on which upload finishes first
+	this.Total += uint64(this.written)
+	this.written = 0
+	this.Chunk++
+	this.hash = md5.New()
+
+	this.pending.Add(1)
+	go this.uploadCache(chunkInfo, cache, fileHash, size)
+
+	// Blocks until a cache is free again
+	this.cache = <-this.free
+
+	return this.err()
+}
+
+// uploadCache uploads one staged chunk and hands its cache back once it is done.
+func (this *ChunkWriter) uploadCache(chunkInfo *Common.ChunkInfo, cache *os.File, fileHash string, size int) {
+	defer this.pending.Done()
+
+	log.Infof("Uploading chunk %d (%s)...", chunkInfo.Chunk, humanize.IBytes(uint64(size)))
+	err := Common.DefaultRetry.Do(fmt.Sprintf("Upload of chunk %d", chunkInfo.Chunk), func() error {
+		_, err := cache.Seek(0, 0)
+		if err != nil {
+			return Common.Permanent(err)
+		}
+		return this.backend.PutChunk(chunkInfo, Common.UploadLimiter.Reader(cache), fileHash)
+	}, this.backend)
+	if err != nil {
+		this.fail(err)
+	} else {
+		log.Infof("Uploaded chunk %d (%s).", chunkInfo.Chunk, humanize.IBytes(uint64(size)))
+	}
+
+	_, err = cache.Seek(0, 0)
+	if err == nil {
+		err = cache.Truncate(0)
+	}
+	if err != nil {
+		this.fail(err)
+	}
+
+	this.free <- cache
+}
+
+// writeStream sends p to the backend as part of the current chunk.
+func (this *ChunkWriter) writeStream(p []byte) (int64, error) {
+	if this.pipe == nil {
+		this.startStream()
+	}
+
+	n, err := this.pipe.Write(p)
+	this.hash.Write(p[:n])
+	this.written += n
+	if err != nil {
+		return int64(this.written), err
+	}
+
+	return int64(this.written), nil
+}
+
+func (this *ChunkWriter) writeSync(p []byte) (int64, error) {
+	if this.streamer != nil {
+		return this.writeStream(p)
+	}
+
+	n, err := this.cache.Write(p)
+	if err != nil {
+		return int64(this.written), err
+	}
+
+	this.hash.Write(p)
+
+	err = this.cache.Sync()
+	if err != nil {
+		return int64(this.written), err
+	}
+
+	this.written += n
+	curloc, err := this.cache.Seek(0, 1)
+	if err != nil {
+		return int64(this.written), err
+	}
+
+	return curloc, nil
+}
+
+func (this *ChunkWriter) Write(p []byte) (int, error) {
+	if this.closed {
+		return 0, E_WRITER_CLOSED
+	}
+	err := this.err()
+	if err != nil {
+		return 0, err
+	}
+
+	if this.written == 0 {
+		log.Infof("Writing into chunk %d...", this.Chunk)
+	}
+
+	buff := make([]byte, len(p))
+	copy(buff, p)
+
+	for (len(buff) + this.written) > this.cacheSize {
+		toWrite := this.cacheSize - this.written
+
+		// Move <toWrite> bytes from buff to smallBuff
+		smallBuff := make([]byte, toWrite)
+		copy(smallBuff, buff)
+		buff = append([]byte(nil), buff[toWrite:]...)
+
+		currentLocation, err := this.writeSync(smallBuff)
+		if err != nil {
+			return 0, err
+		}
+
+		if currentLocation >= int64(this.cacheSize) {
+			err = this.upload()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	currentLocation, err := this.writeSync(buff)
+	if err != nil {
+		return 0, err
+	}
+
+	if currentLocation >= int64(this.cacheSize) {
+		err = this.upload()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (this *ChunkWriter) Close() error {
+	if this.closed {
+		return nil
+	} // Ignore double closes
+	this.closed = true
+
+	err := this.upload()
+
+	// Wait for the uploads still running in the background
+	this.pending.Wait()
+	this.removeCaches()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Uploaded %d chunks for a total of %s.", this.Chunk, humanize.IBytes(this.Total))
+	return this.err()
+}
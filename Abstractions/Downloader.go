@@ -2,8 +2,8 @@ package Abstractions
 
 import (
 	"../Common"
-	"../GoogleDrive"
 	"crypto/cipher"
+	"crypto/hmac"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -16,13 +16,13 @@ import (
 )
 
 type Downloader struct {
-	metadata    *GoogleDrive.Metadata
+	metadata    *Common.Metadata
 	multiWriter io.Writer
 	readProxy   *ReadProxy
 	zr          *lz4.Reader
 	mac         hash.Hash
 	keyStream   cipher.Stream
-	downloader  *GoogleDrive.Reader
+	downloader  *ChunkReader
 	timestamp   int64
 	fileType    string
 }
@@ -30,16 +30,14 @@ type Downloader struct {
 var E_HMAC_MISMATCH = errors.New("HMACs do not match. File has been tampered with, or was not transferred correctly")
 var E_NO_DATA = errors.New("data is 0 bytes")
 
-func NewDownloader(w io.Writer, folder string, filename string, passphrase string, tmpdir string) (*Downloader, error) {
+func NewDownloader(w io.Writer, backend Common.Backend, filename string, keys *Common.Keys, tmpdir string, streaming bool, prefetch uint) (*Downloader, error) {
 	this := &Downloader{}
 
 	var writers []io.Writer
 
-	parent := GoogleDrive.FindOrCreateFolder(folder)
-
 	log.Infoln("Fetching metadata...")
 	var err error
-	this.metadata, err = GoogleDrive.FetchMetadata(filename, parent)
+	this.metadata, err = backend.GetMetadata(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -50,17 +48,52 @@ func NewDownloader(w io.Writer, folder string, filename string, passphrase strin
 
 	var read io.Reader
 
+	if this.metadata.Format > Common.FORMAT_SEALED {
+		return nil, Common.E_UNKNOWN_FORMAT
+	}
+	sealed := this.metadata.Format == Common.FORMAT_SEALED
+	if sealed && !Common.ValidSealedChunkSize(this.metadata.ChunkSize) {
+		return nil, Common.E_BAD_CHUNK_SIZE
+	}
+
+	master, err := keys.Unlock(this.metadata)
+	if err != nil {
+		return nil, err
+	}
 	iv, _ := hex.DecodeString(this.metadata.IV)
-	authenticationKey, encryptionKey := Common.DeriveKeys([]byte(passphrase), iv)
+	// Fail before any chunk is downloaded and decrypted to garbage
+	if this.metadata.KeyCheck != "" && !hmac.Equal([]byte(this.metadata.KeyCheck), []byte(Common.KeyCheck(master, iv))) {
+		return nil, Common.E_WRONG_KEY
+	}
+	// Snapshots with key slots are all uploaded with a parameter check, so it must not be
+	// dropped to have the snapshot read as format 0 without encryption or authentication
+	if this.metadata.ParametersCheck != "" || len(this.metadata.KeySlots) > 0 {
+		if !hmac.Equal([]byte(this.metadata.ParametersCheck), []byte(Common.ParametersCheck(master, this.metadata))) {
+			return nil, Common.E_PARAMETERS
+		}
+	}
+	authenticationKey, encryptionKey := Common.DeriveKeys(master, iv)
 
-	this.mac, this.keyStream = Common.PrepareMACAndEncryption(authenticationKey, encryptionKey, iv, this.metadata.Authentication, this.metadata.Encryption, true)
+	streamEncryption := this.metadata.Encryption
+	if sealed {
+		streamEncryption = "none"
+	}
+	this.mac, this.keyStream = Common.PrepareMACAndEncryption(authenticationKey, encryptionKey, iv, this.metadata.Authentication, streamEncryption, true)
 
-	this.downloader, err = GoogleDrive.NewGoogleDriveReader(this.metadata, tmpdir)
+	this.downloader, err = NewChunkReader(backend, this.metadata, tmpdir, streaming, prefetch)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	if this.keyStream != nil {
+	if sealed {
+		aead, err := Common.NewAEAD(encryptionKey, this.metadata.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Encryption enabled .....: %s, sealed per block", strings.ToUpper(this.metadata.Encryption))
+		// Nothing reaches the writer before the block it is in was verified
+		read = Common.NewOpener(aead, this.metadata.Uuid, this.metadata.ChunkSize, this.downloader)
+	} else if this.keyStream != nil {
 		read = cipher.StreamReader{S: this.keyStream, R: this.downloader}
 	} else {
 		read = this.downloader
@@ -82,7 +115,7 @@ func (this *Downloader) close() error {
 	return this.downloader.Close()
 }
 
-func (this *Downloader) Download() (*GoogleDrive.Metadata, error) {
+func (this *Downloader) Download() (*Common.Metadata, error) {
 	if _, err := io.Copy(this.multiWriter, this.zr); err != nil {
 		if err == lz4.ErrInvalid {
 			return nil, errors.New("lz4 data cannot be decompressed. The file has been tampered with or the encryption-key is incorrect")
@@ -103,8 +136,8 @@ func (this *Downloader) Download() (*GoogleDrive.Metadata, error) {
 
 	if this.metadata.HMAC != hmac {
 		log.Errorln("HMAC does not match")
-		log.Errorf("Wanted:\t%s")
-		log.Errorf("Got:\t%s", this.metadata.HMAC, hmac)
+		log.Errorf("Wanted:\t%s", this.metadata.HMAC)
+		log.Errorf("Got:\t%s", hmac)
 		return this.metadata, E_HMAC_MISMATCH
 	}
 
@@ -0,0 +1,213 @@
+package Abstractions
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"../Common"
+)
+
+// Stretching that keeps the tests fast
+var testArgon2 = Common.Argon2{Time: 1, Memory: 64, Threads: 1}
+
+func testKeys() *Common.Keys {
+	return &Common.Keys{Passphrase: "passphrase", Argon2: testArgon2}
+}
+
+func upload(t *testing.T, backend Common.Backend, keys *Common.Keys, encryption string, data []byte) *Common.Metadata {
+	dir, err := ioutil.TempDir("", "ozbupload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uploader := NewUploader(ioutil.NopCloser(bytes.NewReader(data)), backend, "zfs", "tank/data", "tank/data@1", keys, encryption, "hmac-sha3-512", 1, dir, false, 1)
+	meta, err := uploader.Upload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+func download(t *testing.T, backend Common.Backend, keys *Common.Keys, uuid string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "ozbdownload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var restored bytes.Buffer
+	downloader, err := NewDownloader(&restored, backend, uuid, keys, dir, false, 1)
+	if err != nil {
+		return nil, err
+	}
+	_, err = downloader.Download()
+	return restored.Bytes(), err
+}
+
+func TestUploadDownload(t *testing.T) {
+	// Incompressible, so it spans several chunks of 1 MiB
+	data := make([]byte, 3*1024*1024+5)
+	rand.Read(data)
+
+	for _, encryption := range []string{"aes-ctr", "aes-gcm", "chacha20-poly1305"} {
+		backend := newLocalBackend(t)
+		meta := upload(t, backend, testKeys(), encryption, data)
+		if meta.Chunks < 3 {
+			t.Errorf("%s: uploaded %d chunks", encryption, meta.Chunks)
+		}
+		if sealed := meta.Format == Common.FORMAT_SEALED; sealed != Common.IsAEAD(encryption) {
+			t.Errorf("%s: uploaded in format %d", encryption, meta.Format)
+		}
+
+		restored, err := download(t, backend, testKeys(), meta.Uuid)
+		if err != nil {
+			t.Errorf("%s: download returned %v", encryption, err)
+			continue
+		}
+		if !bytes.Equal(restored, data) {
+			t.Errorf("%s: restored data differs", encryption)
+		}
+	}
+}
+
+// The chunk size of sealed snapshots comes from metadata that is not authenticated
+func TestDownloadInvalidChunkSize(t *testing.T) {
+	for _, chunkSize := range []uint64{0, 1, Common.SEALED_BLOCK_SIZE / 2, Common.SEALED_BLOCK_SIZE + 1} {
+		backend := newLocalBackend(t)
+		err := backend.PutMetadata(&Common.Metadata{Uuid: "u1", FileName: "tank/data@1", Format: Common.FORMAT_SEALED, Encryption: "aes-gcm", ChunkSize: chunkSize, TotalSizeIn: 1, Chunks: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = download(t, backend, testKeys(), "u1")
+		if err != Common.E_BAD_CHUNK_SIZE {
+			t.Errorf("downloading with a chunk size of %d returned %v", chunkSize, err)
+		}
+	}
+}
+
+func TestUploadDownloadRecipients(t *testing.T) {
+	secret, public, err := Common.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1024*1024+5)
+	rand.Read(data)
+
+	backend := newLocalBackend(t)
+	// The uploading host knows its passphrase, but it must not open the snapshot
+	meta := upload(t, backend, &Common.Keys{Passphrase: "passphrase", Recipients: [][]byte{public}}, "aes-gcm", data)
+
+	restored, err := download(t, backend, &Common.Keys{Identities: [][]byte{secret}}, meta.Uuid)
+	if err != nil || !bytes.Equal(restored, data) {
+		t.Errorf("download with the identity returned %v", err)
+	}
+
+	_, err = download(t, backend, testKeys(), meta.Uuid)
+	if err != Common.E_NO_IDENTITY {
+		t.Errorf("download with the passphrase returned %v", err)
+	}
+}
+
+// countingBackend counts the chunks read from it.
+type countingBackend struct {
+	Common.Backend
+	chunks int
+}
+
+func (this *countingBackend) GetChunk(chunk *Common.RemoteChunk, writer io.Writer) (int64, error) {
+	this.chunks++
+	return this.Backend.GetChunk(chunk, writer)
+}
+
+// A wrong key fails before any chunk is downloaded
+func TestDownloadWrongKey(t *testing.T) {
+	data := make([]byte, 1024)
+	rand.Read(data)
+
+	backend := &countingBackend{Backend: newLocalBackend(t)}
+	meta := upload(t, backend, testKeys(), "aes-ctr", data)
+	if meta.KeyCheck == "" {
+		t.Fatalf("uploaded without a key check")
+	}
+	iv, err := hex.DecodeString(meta.IV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Snapshots uploaded before key slots are unlocked with the passphrase itself
+	legacy := *meta
+	legacy.Uuid = "legacy"
+	legacy.KeySlots = nil
+	legacy.KeyCheck = Common.KeyCheck([]byte("passphrase"), iv)
+	tampered := *meta
+	tampered.Uuid = "tampered"
+	tampered.KeyCheck = Common.KeyCheck([]byte("other"), iv)
+	for _, meta := range []*Common.Metadata{&legacy, &tampered} {
+		err = backend.PutMetadata(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		uuid       string
+		passphrase string
+		err        error
+	}{
+		{meta.Uuid, "wrong", Common.E_NO_KEY_SLOTS},
+		{legacy.Uuid, "wrong", Common.E_WRONG_KEY},
+		{tampered.Uuid, "passphrase", Common.E_WRONG_KEY},
+	} {
+		_, err = download(t, backend, &Common.Keys{Passphrase: test.passphrase}, test.uuid)
+		if err != test.err {
+			t.Errorf("%s: download with passphrase %q returned %v, want %v", test.uuid, test.passphrase, err, test.err)
+		}
+	}
+	if backend.chunks != 0 {
+		t.Errorf("downloaded %d chunks with a wrong key", backend.chunks)
+	}
+
+	restored, err := download(t, backend, testKeys(), meta.Uuid)
+	if err != nil || !bytes.Equal(restored, data) {
+		t.Errorf("download with the passphrase returned %v", err)
+	}
+}
+
+// The metadata cannot be changed to have a snapshot read without encryption or authentication
+func TestDownloadDowngrade(t *testing.T) {
+	data := make([]byte, 1024)
+	rand.Read(data)
+
+	backend := &countingBackend{Backend: newLocalBackend(t)}
+	meta := upload(t, backend, testKeys(), "aes-gcm", data)
+	if meta.ParametersCheck == "" {
+		t.Fatalf("uploaded without a parameter check")
+	}
+
+	downgraded := *meta
+	downgraded.Format = Common.FORMAT_STREAM
+	downgraded.ChunkSize = 0
+	downgraded.Encryption = "none"
+	downgraded.Authentication = "none"
+	for name, check := range map[string]string{"kept": meta.ParametersCheck, "dropped": ""} {
+		downgraded.ParametersCheck = check
+		err := backend.PutMetadata(&downgraded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = download(t, backend, testKeys(), meta.Uuid)
+		if err != Common.E_PARAMETERS {
+			t.Errorf("download of the downgraded snapshot with the check %s returned %v", name, err)
+		}
+	}
+	if backend.chunks != 0 {
+		t.Errorf("downloaded %d chunks of a downgraded snapshot", backend.chunks)
+	}
+}
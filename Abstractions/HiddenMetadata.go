@@ -0,0 +1,313 @@
+package Abstractions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"../Common"
+	"golang.org/x/crypto/argon2"
+)
+
+var (
+	E_METADATA_MISMATCH = errors.New("sealed metadata belongs to another snapshot")
+	E_METADATA_SALT     = errors.New("salt of the hidden metadata in the folder is invalid")
+)
+
+// Name of the pointer that holds the salt of the metadata key. Pointers of subvolumes are
+// named after tokens, so it cannot collide with them. Its uuid is empty, so listings of
+// snapshots and cleanups skip it.
+const METADATA_SALT_POINTER = "OZB_metadata_salt"
+
+// Stretching of the passphrase for the metadata key. Changing it would change every token,
+// so it is fixed instead of configurable.
+var metadataArgon2 = Common.Argon2{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// HiddenMetadata keeps everything but the uuid of a snapshot away from the backend.
+// The metadata is stored encrypted, and subvolume and file type are only stored as
+// keyed hashes, so they can still be looked up.
+// The "latest" pointer is named after the hashed subvolume and does not contain the
+// snapshot name.
+type HiddenMetadata struct {
+	backend  Common.Backend
+	tokenKey []byte
+	aead     cipher.AEAD
+}
+
+// NewHiddenMetadata derives the keys of the metadata from passphrase, stretched with the salt
+// of the folder. The salt is stored in the folder the first time.
+func NewHiddenMetadata(backend Common.Backend, passphrase string) (*HiddenMetadata, error) {
+	salt, err := metadataSalt(backend)
+	if err != nil {
+		return nil, err
+	}
+	// Tokens can be checked against guessed subvolume names, so guessing the passphrase
+	// has to cost as much as guessing it against a key slot
+	master := argon2.IDKey([]byte(passphrase), salt, metadataArgon2.Time, metadataArgon2.Memory, metadataArgon2.Threads, 32)
+	tokenKey, sealKey := Common.DeriveKeys(master, []byte("OZB metadata"))
+
+	block, err := aes.NewCipher(sealKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HiddenMetadata{backend: backend, tokenKey: tokenKey, aead: aead}, nil
+}
+
+// metadataSalt returns the salt of the metadata key stored in the folder of backend,
+// storing a new one if there is none yet. It has to stay the same across runs, as the
+// tokens are derived from it.
+func metadataSalt(backend Common.Backend) ([]byte, error) {
+	var pointer *Common.Snapshot
+	err := Common.DefaultRetry.Do("Download of the metadata salt", func() error {
+		var err error
+		pointer, err = backend.GetLatest(METADATA_SALT_POINTER)
+		return err
+	}, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	if pointer != nil {
+		salt, err := hex.DecodeString(pointer.Filename)
+		if err != nil || len(salt) != 32 || pointer.Uuid != "" {
+			return nil, E_METADATA_SALT
+		}
+		return salt, nil
+	}
+
+	salt := make([]byte, 32)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	err = Common.DefaultRetry.Do("Upload of the metadata salt", func() error {
+		return backend.SetLatest(METADATA_SALT_POINTER, &Common.Snapshot{Filename: hex.EncodeToString(salt)})
+	}, backend)
+	return salt, err
+}
+
+// token returns the keyed hash of value that is stored instead of it.
+func (this *HiddenMetadata) token(kind string, value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, this.tokenKey)
+	mac.Write([]byte(kind + "\x00" + value))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+func (this *HiddenMetadata) seal(meta *Common.Metadata) (string, error) {
+	plaintext, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, this.aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	// The uuid is authenticated, so sealed metadata cannot be moved to another snapshot
+	sealed := this.aead.Seal(nonce, nonce, plaintext, []byte(meta.Uuid))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (this *HiddenMetadata) unseal(stored *Common.Metadata) (*Common.Metadata, error) {
+	// Metadata uploaded before hiding was enabled
+	if stored.Sealed == "" {
+		return stored, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(stored.Sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < this.aead.NonceSize() {
+		return nil, E_METADATA_MISMATCH
+	}
+
+	nonce := sealed[:this.aead.NonceSize()]
+	plaintext, err := this.aead.Open(nil, nonce, sealed[this.aead.NonceSize():], []byte(stored.Uuid))
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &Common.Metadata{}
+	err = json.Unmarshal(plaintext, meta)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Uuid != stored.Uuid {
+		return nil, E_METADATA_MISMATCH
+	}
+
+	return meta, nil
+}
+
+func (this *HiddenMetadata) PutChunk(info *Common.ChunkInfo, reader io.Reader, wantedMD5 string) error {
+	// Backends only store the uuid and index of a chunk
+	return this.backend.PutChunk(info, reader, wantedMD5)
+}
+
+func (this *HiddenMetadata) StreamChunk(info *Common.ChunkInfo, reader io.Reader) (string, error) {
+	streamer, ok := this.backend.(Common.ChunkStreamer)
+	if !ok {
+		return "", Common.E_NO_STREAMING
+	}
+	return streamer.StreamChunk(info, reader)
+}
+
+func (this *HiddenMetadata) ListChunks(uuid string) ([]*Common.RemoteChunk, error) {
+	return this.backend.ListChunks(uuid)
+}
+
+func (this *HiddenMetadata) ChunkMD5(chunk *Common.RemoteChunk) (string, error) {
+	hasher, ok := this.backend.(Common.ChunkHasher)
+	if !ok {
+		return chunk.MD5, nil
+	}
+	return hasher.ChunkMD5(chunk)
+}
+
+func (this *HiddenMetadata) GetChunk(chunk *Common.RemoteChunk, writer io.Writer) (int64, error) {
+	return this.backend.GetChunk(chunk, writer)
+}
+
+func (this *HiddenMetadata) PutMetadata(meta *Common.Metadata) error {
+	sealed, err := this.seal(meta)
+	if err != nil {
+		return err
+	}
+
+	return this.backend.PutMetadata(&Common.Metadata{
+		Uuid:      meta.Uuid,
+		FileType:  this.token("filetype", meta.FileType),
+		Subvolume: this.token("subvolume", meta.Subvolume),
+		Sealed:    sealed,
+	})
+}
+
+func (this *HiddenMetadata) GetMetadata(uuid string) (*Common.Metadata, error) {
+	stored, err := this.backend.GetMetadata(uuid)
+	if err != nil {
+		return nil, err
+	}
+	return this.unseal(stored)
+}
+
+// ListMetadata has to fetch the metadata of every snapshot, as the listing of the
+// backend only contains the tokens.
+func (this *HiddenMetadata) ListMetadata(fileType string, subvolume string, callback func(*Common.Metadata)) error {
+	var uuids []string
+	err := this.backend.ListMetadata(this.token("filetype", fileType), this.token("subvolume", subvolume), func(stored *Common.Metadata) {
+		uuids = append(uuids, stored.Uuid)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, uuid := range uuids {
+		meta, err := this.GetMetadata(uuid)
+		if err != nil {
+			return err
+		}
+		callback(meta)
+	}
+
+	return nil
+}
+
+func (this *HiddenMetadata) GetLatest(subvolume string) (*Common.Snapshot, error) {
+	latest, err := this.backend.GetLatest(this.token("subvolume", subvolume))
+	if err != nil || latest == nil {
+		return latest, err
+	}
+
+	meta, err := this.GetMetadata(latest.Uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Common.Snapshot{Uuid: meta.Uuid, Filename: meta.FileName}, nil
+}
+
+func (this *HiddenMetadata) SetLatest(subvolume string, latest *Common.Snapshot) error {
+	return this.backend.SetLatest(this.token("subvolume", subvolume), &Common.Snapshot{Uuid: latest.Uuid})
+}
+
+func (this *HiddenMetadata) ListUuids() ([]string, error) {
+	return this.backend.ListUuids()
+}
+
+func (this *HiddenMetadata) Delete(uuid string) error {
+	return this.backend.Delete(uuid)
+}
+
+func (this *HiddenMetadata) quarantiner() (Common.Quarantiner, error) {
+	quarantiner, ok := this.backend.(Common.Quarantiner)
+	if !ok {
+		return nil, Common.E_NO_QUARANTINE
+	}
+	return quarantiner, nil
+}
+
+func (this *HiddenMetadata) Quarantine(uuid string) error {
+	quarantiner, err := this.quarantiner()
+	if err != nil {
+		return err
+	}
+	return quarantiner.Quarantine(uuid)
+}
+
+func (this *HiddenMetadata) ListQuarantined() (map[string]time.Time, error) {
+	quarantiner, err := this.quarantiner()
+	if err != nil {
+		return nil, err
+	}
+	return quarantiner.ListQuarantined()
+}
+
+func (this *HiddenMetadata) RestoreQuarantined(uuid string) error {
+	quarantiner, err := this.quarantiner()
+	if err != nil {
+		return err
+	}
+	return quarantiner.RestoreQuarantined(uuid)
+}
+
+func (this *HiddenMetadata) Purge(uuid string) error {
+	quarantiner, err := this.quarantiner()
+	if err != nil {
+		return err
+	}
+	return quarantiner.Purge(uuid)
+}
+
+func (this *HiddenMetadata) ClassifyError(err error) *Common.ErrorClass {
+	if err == E_METADATA_MISMATCH || err == E_METADATA_SALT {
+		return &Common.ErrorClass{Permanent: true}
+	}
+	if classifier, ok := this.backend.(Common.ErrorClassifier); ok {
+		return classifier.ClassifyError(err)
+	}
+	return nil
+}
+
+func (this *HiddenMetadata) Quota() (*Common.Quota, error) {
+	return this.backend.Quota()
+}
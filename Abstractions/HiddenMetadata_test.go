@@ -0,0 +1,70 @@
+package Abstractions
+
+import (
+	"testing"
+
+	"../Common"
+)
+
+func hide(t *testing.T, backend Common.Backend, passphrase string) *HiddenMetadata {
+	hidden, err := NewHiddenMetadata(backend, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hidden
+}
+
+func TestHiddenMetadataSalt(t *testing.T) {
+	backend := newLocalBackend(t)
+	hidden := hide(t, backend, "passphrase")
+	err := hidden.PutMetadata(&Common.Metadata{Uuid: "u1", FileName: "tank/data@1", Subvolume: "tank/data", FileType: "zfs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hidden.SetLatest("tank/data", &Common.Snapshot{Uuid: "u1", Filename: "tank/data@1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := backend.GetMetadata("u1")
+	if err != nil || stored.FileName != "" || stored.Subvolume == "tank/data" || stored.Sealed == "" {
+		t.Fatalf("stored metadata %+v, %v", stored, err)
+	}
+
+	// The salt stored by the first run is used by the next ones
+	latest, err := hide(t, backend, "passphrase").GetLatest("tank/data")
+	if err != nil || latest == nil || latest.Filename != "tank/data@1" {
+		t.Fatalf("GetLatest after reopening returned %+v, %v", latest, err)
+	}
+
+	// Other folders get their own salt, so the same passphrase gives other tokens
+	other := newLocalBackend(t)
+	otherHidden := hide(t, other, "passphrase")
+	err = otherHidden.PutMetadata(&Common.Metadata{Uuid: "u2", Subvolume: "tank/data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherStored, err := other.GetMetadata("u2")
+	if err != nil || otherStored.Subvolume == stored.Subvolume {
+		t.Errorf("both folders store the token %q", stored.Subvolume)
+	}
+
+	// The salt is no snapshot, so cleanups leave it alone
+	uuids, err := backend.ListUuids()
+	if err != nil || len(uuids) != 1 || uuids[0] != "u1" {
+		t.Errorf("ListUuids returned %v, %v", uuids, err)
+	}
+}
+
+func TestHiddenMetadataInvalidSalt(t *testing.T) {
+	backend := newLocalBackend(t)
+	err := backend.SetLatest(METADATA_SALT_POINTER, &Common.Snapshot{Filename: "not hex"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewHiddenMetadata(backend, "passphrase")
+	if err != E_METADATA_SALT {
+		t.Errorf("NewHiddenMetadata with an invalid salt returned %v", err)
+	}
+}
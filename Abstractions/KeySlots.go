@@ -0,0 +1,83 @@
+package Abstractions
+
+import (
+	"errors"
+
+	"github.com/prometheus/common/log"
+
+	"../Common"
+)
+
+var E_KEY_SLOTS_SKIPPED = errors.New("the key slots of some snapshots could not be changed, see above")
+
+// ChangeKeySlots calls change with the metadata of every snapshot of subvolume, or of every
+// snapshot for an empty subvolume, and writes back the metadata it changed. The chunks stay
+// as they are. Every target of a Mirror is changed on its own.
+// Snapshots change fails for, e.g. as the keys do not open them, are skipped. Once every other
+// snapshot was changed, E_KEY_SLOTS_SKIPPED is returned. Snapshots uploaded before key slots
+// are skipped without an error.
+func ChangeKeySlots(backend Common.Backend, subvolume string, change func(meta *Common.Metadata) (bool, error)) error {
+	if mirror, ok := backend.(*Mirror); ok {
+		var skipped error
+		for _, target := range mirror.Targets {
+			log.Infof("Changing key slots on '%s'...", target.Name)
+			err := ChangeKeySlots(target.Backend, subvolume, change)
+			if err == E_KEY_SLOTS_SKIPPED {
+				skipped = err
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return skipped
+	}
+
+	var uuids []string
+	err := backend.ListMetadata("", subvolume, func(meta *Common.Metadata) {
+		uuids = append(uuids, meta.Uuid)
+	})
+	if err != nil {
+		return err
+	}
+
+	skipped := 0
+	for _, uuid := range uuids {
+		var meta *Common.Metadata
+		err = Common.DefaultRetry.Do("Download of metadata", func() error {
+			meta, err = backend.GetMetadata(uuid)
+			return err
+		}, backend)
+		if err != nil {
+			return err
+		}
+
+		changed, err := change(meta)
+		if err == Common.E_LEGACY_KEY {
+			log.Warnf("Skipping '%s' (%s): %s", meta.FileName, meta.Uuid, err)
+			continue
+		}
+		if err != nil {
+			log.Errorf("Skipping '%s' (%s): %s", meta.FileName, meta.Uuid, err)
+			skipped++
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		err = Common.DefaultRetry.Do("Upload of metadata", func() error {
+			return backend.PutMetadata(meta)
+		}, backend)
+		if err != nil {
+			return err
+		}
+		log.Infof("Key slots of '%s' (%s) changed", meta.FileName, meta.Uuid)
+	}
+
+	if skipped > 0 {
+		log.Errorf("Skipped %d of %d snapshots", skipped, len(uuids))
+		return E_KEY_SLOTS_SKIPPED
+	}
+	return nil
+}
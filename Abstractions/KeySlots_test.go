@@ -0,0 +1,140 @@
+package Abstractions
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"../Common"
+)
+
+func addSlots(backend Common.Backend, keys *Common.Keys, add *Common.Keys) error {
+	return ChangeKeySlots(backend, "", func(meta *Common.Metadata) (bool, error) {
+		return true, keys.AddKeySlots(meta, add)
+	})
+}
+
+func removeSlots(backend Common.Backend, keys *Common.Keys) error {
+	return ChangeKeySlots(backend, "", func(meta *Common.Metadata) (bool, error) {
+		removed, err := keys.RemoveKeySlots(meta)
+		return removed > 0, err
+	})
+}
+
+func TestRotatePassphrase(t *testing.T) {
+	oldKeys := &Common.Keys{Passphrase: "old", Argon2: testArgon2}
+	newKeys := &Common.Keys{Passphrase: "new", Argon2: testArgon2}
+	data := make([]byte, 1024)
+	rand.Read(data)
+
+	first := newLocalBackend(t)
+	second := newLocalBackend(t)
+	mirror := NewMirror([]*MirrorTarget{{Name: "first", Backend: first}, {Name: "second", Backend: second}})
+	meta := upload(t, mirror, oldKeys, "aes-gcm", data)
+
+	err := addSlots(mirror, oldKeys, newKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = removeSlots(mirror, oldKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every target of the mirror is rotated
+	for name, backend := range map[string]Common.Backend{"first": first, "second": second} {
+		restored, err := download(t, backend, newKeys, meta.Uuid)
+		if err != nil || !bytes.Equal(restored, data) {
+			t.Errorf("%s: download with the new passphrase returned %v", name, err)
+		}
+		_, err = download(t, backend, oldKeys, meta.Uuid)
+		if err != Common.E_NO_KEY_SLOTS {
+			t.Errorf("%s: download with the removed passphrase returned %v", name, err)
+		}
+	}
+
+	// The last slot is refused with E_LAST_SLOT, so the snapshot is skipped on both targets
+	err = removeSlots(mirror, newKeys)
+	if err != E_KEY_SLOTS_SKIPPED {
+		t.Errorf("removing the last slot returned %v", err)
+	}
+	_, err = download(t, first, newKeys, meta.Uuid)
+	if err != nil {
+		t.Errorf("the last slot was removed: %v", err)
+	}
+}
+
+// Snapshots the keys do not open are skipped, and the others are still changed
+func TestChangeKeySlotsSkips(t *testing.T) {
+	keys := &Common.Keys{Passphrase: "passphrase", Argon2: testArgon2}
+	otherKeys := &Common.Keys{Passphrase: "other", Argon2: testArgon2}
+	newKeys := &Common.Keys{Passphrase: "new", Argon2: testArgon2}
+	data := make([]byte, 1024)
+	rand.Read(data)
+
+	backend := newLocalBackend(t)
+	var opened []string
+	for i := 0; i < 2; i++ {
+		opened = append(opened, upload(t, backend, keys, "aes-gcm", data).Uuid)
+	}
+	other := upload(t, backend, otherKeys, "aes-gcm", data)
+
+	err := addSlots(backend, keys, newKeys)
+	if err != E_KEY_SLOTS_SKIPPED {
+		t.Fatalf("adding slots returned %v", err)
+	}
+	for _, uuid := range opened {
+		_, err = download(t, backend, newKeys, uuid)
+		if err != nil {
+			t.Errorf("download of %s with the added passphrase returned %v", uuid, err)
+		}
+	}
+	_, err = download(t, backend, newKeys, other.Uuid)
+	if err != Common.E_NO_KEY_SLOTS {
+		t.Errorf("download of the skipped snapshot with the added passphrase returned %v", err)
+	}
+}
+
+// Hidden metadata is keyed with the passphrase it was set up with, not with a key slot,
+// so only recipients can be added with it.
+func TestKeySlotsOfHiddenMetadata(t *testing.T) {
+	keys := &Common.Keys{Passphrase: "passphrase", Argon2: testArgon2}
+	secret, public, err := Common.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1024)
+	rand.Read(data)
+
+	backend := newLocalBackend(t)
+	hidden, err := NewHiddenMetadata(backend, keys.Passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := upload(t, hidden, keys, "aes-gcm", data)
+
+	err = addSlots(hidden, keys, &Common.Keys{Recipients: [][]byte{public}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, keys := range map[string]*Common.Keys{"passphrase": keys, "identity": {Identities: [][]byte{secret}}} {
+		restored, err := download(t, hidden, keys, meta.Uuid)
+		if err != nil || !bytes.Equal(restored, data) {
+			t.Errorf("download with the %s returned %v", name, err)
+		}
+	}
+
+	// What a rotated passphrase would see
+	other, err := NewHiddenMetadata(backend, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, err := other.GetLatest("tank/data")
+	if err == nil && latest != nil {
+		t.Errorf("another passphrase found the latest snapshot")
+	}
+	_, err = other.GetMetadata(meta.Uuid)
+	if err == nil {
+		t.Errorf("another passphrase opened the hidden metadata")
+	}
+}
@@ -0,0 +1,205 @@
+package Abstractions
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"../Common"
+	"github.com/dustin/go-humanize"
+	"github.com/prometheus/common/log"
+)
+
+const MIGRATE_CACHE_FILENAME = "OZBMigrateCache"
+
+// Maximum attempts per chunk before a migration is aborted. It can be resumed by starting it again.
+const MIGRATE_ATTEMPTS = 5
+
+// Migrate copies the chain of subvolume from source to target as it is stored,
+// without decrypting it. Every chunk is verified against the MD5 reported by the
+// source and the target.
+// Snapshots and chunks that are already on target are skipped, so an interrupted
+// migration is resumed by running it again.
+func Migrate(source Common.Backend, target Common.Backend, subvolume string, tmpBase string) error {
+	latest, err := source.GetLatest(subvolume)
+	if err != nil {
+		return err
+	}
+	if latest == nil {
+		return Common.E_NO_LATEST
+	}
+
+	chain := BuildChain(source, subvolume, false)
+	log.Infof("Migrating %d snapshots of '%s'...", len(chain), subvolume)
+
+	if tmpBase == "" {
+		stat, err := os.Stat("/dev/shm")
+		if err == nil && stat.IsDir() {
+			tmpBase = "/dev/shm"
+			log.Infoln("Using shared memory as cache...")
+		}
+	}
+
+	err = os.MkdirAll(tmpBase, 0777)
+	if err != nil {
+		return err
+	}
+
+	cache, err := ioutil.TempFile(tmpBase, MIGRATE_CACHE_FILENAME)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(cache.Name())
+	defer cache.Close()
+
+	for _, snapshot := range chain {
+		err = migrateSnapshot(source, target, snapshot.Uuid, cache)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only point to the copied chain once all of it is there
+	err = target.SetLatest(subvolume, latest)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Latest snapshot of '%s' on the target is now '%s'", subvolume, latest.Filename)
+	return nil
+}
+
+func migrateSnapshot(source Common.Backend, target Common.Backend, uuid string, cache *os.File) error {
+	meta, err := source.GetMetadata(uuid)
+	if err != nil {
+		return err
+	}
+
+	// Metadata is stored last, so the snapshot is complete if it exists
+	_, err = target.GetMetadata(uuid)
+	if err == nil {
+		log.Infof("'%s' is already on the target", meta.FileName)
+		return nil
+	}
+	if err != Common.E_NO_METADATA {
+		return err
+	}
+
+	log.Infof("Migrating '%s' (%d chunks, %s)...", meta.FileName, meta.Chunks, humanize.IBytes(meta.TotalSize))
+
+	sourceChunks, err := source.ListChunks(uuid)
+	if err != nil {
+		return err
+	}
+	if uint(len(sourceChunks)) != meta.Chunks {
+		return E_CHUNKS_MISSING
+	}
+	sort.Slice(sourceChunks, func(i, j int) bool { return sourceChunks[i].Chunk < sourceChunks[j].Chunk })
+
+	targetChunks, err := target.ListChunks(uuid)
+	if err != nil {
+		return err
+	}
+	existing := make(map[uint]*Common.RemoteChunk)
+	for _, chunk := range targetChunks {
+		existing[chunk.Chunk] = chunk
+	}
+
+	for _, chunk := range sourceChunks {
+		copied := existing[chunk.Chunk]
+		if copied != nil && copied.Size == chunk.Size {
+			same, err := sameMD5(source, chunk, target, copied)
+			if err != nil {
+				return err
+			}
+			if same {
+				log.Infof("Chunk %d is already on the target", chunk.Chunk)
+				continue
+			}
+		}
+
+		info := &Common.ChunkInfo{Uuid: meta.Uuid, Encryption: meta.Encryption, Authentication: meta.Authentication, IsData: true, FileName: meta.FileName, Chunk: chunk.Chunk}
+		err = retry(fmt.Sprintf("Migration of chunk %d", chunk.Chunk), func() error {
+			return migrateChunk(source, target, chunk, info, cache)
+		}, source, target)
+		if err != nil {
+			return err
+		}
+	}
+
+	return retry("Migration of metadata", func() error {
+		return target.PutMetadata(meta)
+	}, target)
+}
+
+// chunkMD5 returns the MD5 of chunk, asking the backend if the listing did not contain it.
+func chunkMD5(backend Common.Backend, chunk *Common.RemoteChunk) (string, error) {
+	hasher, ok := backend.(Common.ChunkHasher)
+	if chunk.MD5 != "" || !ok {
+		return chunk.MD5, nil
+	}
+
+	var md5 string
+	err := Common.DefaultRetry.Do(fmt.Sprintf("MD5 of chunk %d", chunk.Chunk), func() error {
+		var err error
+		md5, err = hasher.ChunkMD5(chunk)
+		return err
+	}, backend)
+	chunk.MD5 = md5
+	return md5, err
+}
+
+// sameMD5 tells whether a chunk was already copied to target. Unknown MD5s are never the same.
+func sameMD5(source Common.Backend, chunk *Common.RemoteChunk, target Common.Backend, copied *Common.RemoteChunk) (bool, error) {
+	sourceMD5, err := chunkMD5(source, chunk)
+	if err != nil || sourceMD5 == "" {
+		return false, err
+	}
+	targetMD5, err := chunkMD5(target, copied)
+	return sourceMD5 == targetMD5, err
+}
+
+// migrateChunk downloads a chunk into cache, verifies it and uploads it to target.
+func migrateChunk(source Common.Backend, target Common.Backend, chunk *Common.RemoteChunk, info *Common.ChunkInfo, cache *os.File) error {
+	_, err := cache.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	err = cache.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	hash := md5.New()
+	n, err := source.GetChunk(chunk, Common.DownloadLimiter.Writer(io.MultiWriter(cache, hash)))
+	if err != nil {
+		return err
+	}
+
+	fileMD5 := fmt.Sprintf("%x", hash.Sum(nil))
+	// The chunk is corrupted on the source, downloading it again does not help
+	if chunk.MD5 != "" && fileMD5 != chunk.MD5 {
+		return Common.Permanent(Common.E_BACKEND_HASH_MISMATCH)
+	}
+
+	_, err = cache.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	// The target verifies the stored chunk against fileMD5
+	err = target.PutChunk(info, Common.UploadLimiter.Reader(cache), fileMD5)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Migrated chunk %d (%s)", chunk.Chunk, humanize.IBytes(uint64(n)))
+	return nil
+}
+
+func retry(what string, fn func() error, backends ...Common.Backend) error {
+	return Common.DefaultRetry.WithAttempts(MIGRATE_ATTEMPTS).Do(what, fn, backends...)
+}
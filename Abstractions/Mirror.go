@@ -0,0 +1,394 @@
+package Abstractions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"../Common"
+	"github.com/prometheus/common/log"
+)
+
+// Attempts per target before a mirror target is given up on for the current snapshot
+const MIRROR_ATTEMPTS = 3
+
+var (
+	E_MIRROR_INCOMPLETE = errors.New("not every mirror target received the snapshot")
+	E_MIRROR_NO_TARGETS = errors.New("no mirror target left")
+)
+
+type MirrorTarget struct {
+	Name    string
+	Backend Common.Backend
+	// Why the target was given up on. Nothing is written to it afterwards.
+	Failed error
+}
+
+// Mirror writes every chunk of a snapshot to all of its targets, so one `zfs send`
+// ends up on multiple backends.
+// A target that keeps failing is dropped, so the others still get the whole snapshot.
+// The last remaining target is never dropped. Its errors are returned and retried by
+// the caller, the same way as with a single backend.
+// Reads go to the first target that has not failed, and fall back to the next one
+// if it cannot be read from. Chunk ids differ between backends, so a chunk is looked
+// up again by its number on the target it is read from.
+// Chunks may be put concurrently.
+type Mirror struct {
+	Targets []*MirrorTarget
+	// Guards Failed of the targets and the listed chunks
+	lock sync.Mutex
+	// Chunks of a snapshot per target, as listed by that target
+	listed map[*MirrorTarget]map[string][]*Common.RemoteChunk
+	// Snapshot of every chunk returned by ListChunks
+	uuids map[*Common.RemoteChunk]string
+}
+
+func NewMirror(targets []*MirrorTarget) *Mirror {
+	return &Mirror{
+		Targets: targets,
+		listed:  make(map[*MirrorTarget]map[string][]*Common.RemoteChunk),
+		uuids:   make(map[*Common.RemoteChunk]string),
+	}
+}
+
+func (this *Mirror) active() []*MirrorTarget {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var active []*MirrorTarget
+	for _, target := range this.Targets {
+		if target.Failed == nil {
+			active = append(active, target)
+		}
+	}
+	return active
+}
+
+// fail gives up on target for the current snapshot.
+func (this *Mirror) fail(target *MirrorTarget, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	target.Failed = err
+}
+
+// read runs fn for the active targets in order until it succeeds for one of them.
+// It returns the error of the first target if it failed for every target.
+func (this *Mirror) read(what string, fn func(target *MirrorTarget) error) error {
+	active := this.active()
+	if len(active) == 0 {
+		return E_MIRROR_NO_TARGETS
+	}
+
+	var first error
+	for _, target := range active {
+		err := fn(target)
+		if err == nil {
+			return nil
+		}
+		if first == nil {
+			first = err
+		}
+		log.Warnf("%s from '%s' failed: %s", what, target.Name, err)
+	}
+	return first
+}
+
+// each runs fn for every active target, dropping the targets it fails for.
+// It returns an error if it failed for every target.
+func (this *Mirror) each(what string, fn func(target *MirrorTarget) error) error {
+	active := this.active()
+	if len(active) == 0 {
+		return E_MIRROR_NO_TARGETS
+	}
+
+	policy := Common.DefaultRetry.WithAttempts(MIRROR_ATTEMPTS)
+	succeeded := 0
+	for i, target := range active {
+		err := policy.Do(fmt.Sprintf("%s on '%s'", what, target.Name), func() error {
+			return fn(target)
+		}, target.Backend)
+		if err == nil {
+			succeeded++
+			continue
+		}
+		if succeeded == 0 && i == len(active)-1 {
+			return err
+		}
+		log.Errorf("Giving up on '%s' for this snapshot", target.Name)
+		this.fail(target, fmt.Errorf("%s: %s", what, err))
+	}
+
+	return nil
+}
+
+func (this *Mirror) PutChunk(info *Common.ChunkInfo, reader io.Reader, wantedMD5 string) error {
+	seeker, ok := reader.(io.ReadSeeker)
+	if !ok {
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		seeker = bytes.NewReader(data)
+	}
+
+	return this.each(fmt.Sprintf("Upload of chunk %d", info.Chunk), func(target *MirrorTarget) error {
+		_, err := seeker.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		return target.Backend.PutChunk(info, seeker, wantedMD5)
+	})
+}
+
+func (this *Mirror) PutMetadata(meta *Common.Metadata) error {
+	return this.each("Upload of metadata", func(target *MirrorTarget) error {
+		return target.Backend.PutMetadata(meta)
+	})
+}
+
+// GetLatest returns the latest snapshot of the first target that can be reached.
+// Every other target has to have that snapshot as well, as it becomes the parent of
+// the next one. Targets that do not are left out of the next backup.
+func (this *Mirror) GetLatest(subvolume string) (*Common.Snapshot, error) {
+	var latest *Common.Snapshot
+	var source *MirrorTarget
+	for _, target := range this.active() {
+		snapshot, err := target.Backend.GetLatest(subvolume)
+		if err != nil {
+			log.Errorf("Could not get latest snapshot from '%s': %s", target.Name, err)
+			this.fail(target, err)
+			continue
+		}
+		latest = snapshot
+		source = target
+		break
+	}
+	if source == nil {
+		return nil, E_MIRROR_NO_TARGETS
+	}
+	if latest == nil {
+		return nil, nil
+	}
+
+	for _, target := range this.active() {
+		if target == source {
+			continue
+		}
+		_, err := target.Backend.GetMetadata(latest.Uuid)
+		if err == Common.E_NO_METADATA {
+			log.Errorf("'%s' does not have '%s' of '%s'. Backup with --full or migrate the chain to it.", target.Name, latest.Filename, source.Name)
+		} else if err != nil {
+			log.Errorf("Could not check '%s' for '%s': %s", target.Name, latest.Filename, err)
+		}
+		if err != nil {
+			this.fail(target, err)
+		}
+	}
+
+	return latest, nil
+}
+
+// SetLatest only advances the pointer on targets that received the whole snapshot.
+func (this *Mirror) SetLatest(subvolume string, latest *Common.Snapshot) error {
+	return this.each("Update of latest snapshot", func(target *MirrorTarget) error {
+		return target.Backend.SetLatest(subvolume, latest)
+	})
+}
+
+// Report logs the outcome per target and returns E_MIRROR_INCOMPLETE if any of them failed.
+func (this *Mirror) Report() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var err error
+	for _, target := range this.Targets {
+		if target.Failed != nil {
+			log.Errorf("Mirror '%s': failed (%s)", target.Name, target.Failed)
+			err = E_MIRROR_INCOMPLETE
+		} else {
+			log.Infof("Mirror '%s': ok", target.Name)
+		}
+	}
+	return err
+}
+
+// remember keeps the chunks of uuid that target listed.
+func (this *Mirror) remember(target *MirrorTarget, uuid string, chunks []*Common.RemoteChunk) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.listed[target] == nil {
+		this.listed[target] = make(map[string][]*Common.RemoteChunk)
+	}
+	this.listed[target][uuid] = chunks
+	for _, chunk := range chunks {
+		this.uuids[chunk] = uuid
+	}
+}
+
+func (this *Mirror) ListChunks(uuid string) ([]*Common.RemoteChunk, error) {
+	var chunks []*Common.RemoteChunk
+	err := this.read("Listing of chunks", func(target *MirrorTarget) error {
+		var err error
+		chunks, err = target.Backend.ListChunks(uuid)
+		if err == nil {
+			this.remember(target, uuid, chunks)
+		}
+		return err
+	})
+	return chunks, err
+}
+
+// targetChunk returns the chunk of target with the same snapshot and number as chunk,
+// listing the chunks of target the first time they are needed.
+func (this *Mirror) targetChunk(target *MirrorTarget, chunk *Common.RemoteChunk) (*Common.RemoteChunk, error) {
+	this.lock.Lock()
+	uuid, known := this.uuids[chunk]
+	chunks, listed := this.listed[target][uuid]
+	this.lock.Unlock()
+
+	// Not returned by ListChunks, so there is nothing to look it up by
+	if !known {
+		return chunk, nil
+	}
+	if !listed {
+		var err error
+		chunks, err = target.Backend.ListChunks(uuid)
+		if err != nil {
+			return nil, err
+		}
+		this.remember(target, uuid, chunks)
+	}
+
+	for _, own := range chunks {
+		if own.Chunk == chunk.Chunk {
+			return own, nil
+		}
+	}
+	return nil, fmt.Errorf("chunk %d of %s is missing", chunk.Chunk, uuid)
+}
+
+// countingWriter counts what was passed on to writer.
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (this *countingWriter) Write(p []byte) (int, error) {
+	n, err := this.writer.Write(p)
+	this.written += int64(n)
+	return n, err
+}
+
+// GetChunk only falls back to the next target if nothing was written yet, as what
+// was written cannot be taken back. The caller retries it from the start.
+func (this *Mirror) GetChunk(chunk *Common.RemoteChunk, writer io.Writer) (int64, error) {
+	active := this.active()
+	if len(active) == 0 {
+		return 0, E_MIRROR_NO_TARGETS
+	}
+
+	counter := &countingWriter{writer: writer}
+	var first error
+	for _, target := range active {
+		own, err := this.targetChunk(target, chunk)
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			log.Warnf("Lookup of chunk %d on '%s' failed: %s", chunk.Chunk, target.Name, err)
+			continue
+		}
+
+		n, err := target.Backend.GetChunk(own, counter)
+		if err == nil {
+			// The caller verifies the chunk against the MD5 it was listed with
+			if chunk.MD5 == "" {
+				chunk.MD5 = own.MD5
+			}
+			return n, nil
+		}
+		if first == nil {
+			first = err
+		}
+		if counter.written > 0 {
+			return n, err
+		}
+		log.Warnf("Download of chunk %d from '%s' failed: %s", chunk.Chunk, target.Name, err)
+	}
+	return 0, first
+}
+
+func (this *Mirror) GetMetadata(uuid string) (*Common.Metadata, error) {
+	var meta *Common.Metadata
+	err := this.read("Download of metadata", func(target *MirrorTarget) error {
+		var err error
+		meta, err = target.Backend.GetMetadata(uuid)
+		return err
+	})
+	return meta, err
+}
+
+// ListMetadata only calls callback once a target listed everything, so nothing is
+// passed twice after falling back to the next target.
+func (this *Mirror) ListMetadata(fileType string, subvolume string, callback func(*Common.Metadata)) error {
+	var listed []*Common.Metadata
+	err := this.read("Listing of metadata", func(target *MirrorTarget) error {
+		listed = nil
+		return target.Backend.ListMetadata(fileType, subvolume, func(meta *Common.Metadata) {
+			listed = append(listed, meta)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, meta := range listed {
+		callback(meta)
+	}
+	return nil
+}
+
+func (this *Mirror) ListUuids() ([]string, error) {
+	var uuids []string
+	err := this.read("Listing of snapshots", func(target *MirrorTarget) error {
+		var err error
+		uuids, err = target.Backend.ListUuids()
+		return err
+	})
+	return uuids, err
+}
+
+func (this *Mirror) Delete(uuid string) error {
+	return this.Targets[0].Backend.Delete(uuid)
+}
+
+// ClassifyError asks the targets, as the error may have come from any of them.
+func (this *Mirror) ClassifyError(err error) *Common.ErrorClass {
+	if err == E_MIRROR_NO_TARGETS {
+		return &Common.ErrorClass{Permanent: true}
+	}
+	for _, target := range this.Targets {
+		if classifier, ok := target.Backend.(Common.ErrorClassifier); ok {
+			class := classifier.ClassifyError(err)
+			if class != nil {
+				return class
+			}
+		}
+	}
+	return nil
+}
+
+func (this *Mirror) Quota() (*Common.Quota, error) {
+	var quota *Common.Quota
+	err := this.read("Quota", func(target *MirrorTarget) error {
+		var err error
+		quota, err = target.Backend.Quota()
+		return err
+	})
+	return quota, err
+}
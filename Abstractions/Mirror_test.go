@@ -0,0 +1,220 @@
+package Abstractions
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"../Common"
+	"../Local"
+)
+
+var errBroken = errors.New("broken target")
+
+// brokenBackend fails every read. GetChunk writes partial before failing.
+type brokenBackend struct {
+	Common.Backend
+	partial []byte
+}
+
+func (this *brokenBackend) GetLatest(subvolume string) (*Common.Snapshot, error) {
+	return nil, errBroken
+}
+
+func (this *brokenBackend) GetMetadata(uuid string) (*Common.Metadata, error) {
+	return nil, errBroken
+}
+
+func (this *brokenBackend) ListMetadata(fileType string, subvolume string, callback func(*Common.Metadata)) error {
+	callback(&Common.Metadata{Uuid: "partial"})
+	return errBroken
+}
+
+func (this *brokenBackend) ListChunks(uuid string) ([]*Common.RemoteChunk, error) {
+	return nil, errBroken
+}
+
+func (this *brokenBackend) GetChunk(chunk *Common.RemoteChunk, writer io.Writer) (int64, error) {
+	n, _ := writer.Write(this.partial)
+	return int64(n), errBroken
+}
+
+func newLocalBackend(t *testing.T) *Local.Backend {
+	dir, err := ioutil.TempDir("", "ozbmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	backend, err := Local.NewBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+// newTestMirror returns a mirror of a broken target and a working one holding snapshot "u1".
+func newTestMirror(t *testing.T, partial []byte) (*Mirror, []byte) {
+	working := newLocalBackend(t)
+	data := []byte("chunk of u1")
+	info := &Common.ChunkInfo{Uuid: "u1", FileName: "tank/data@1", IsData: true, Chunk: 0}
+	err := working.PutChunk(info, bytes.NewReader(data), fmt.Sprintf("%x", md5.Sum(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = working.PutMetadata(&Common.Metadata{Uuid: "u1", FileName: "tank/data@1", Subvolume: "tank/data", Chunks: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = working.SetLatest("tank/data", &Common.Snapshot{Uuid: "u1", Filename: "tank/data@1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewMirror([]*MirrorTarget{
+		{Name: "broken", Backend: &brokenBackend{Backend: newLocalBackend(t), partial: partial}},
+		{Name: "working", Backend: working},
+	}), data
+}
+
+func TestMirrorReadFallback(t *testing.T) {
+	mirror, data := newTestMirror(t, nil)
+
+	meta, err := mirror.GetMetadata("u1")
+	if err != nil || meta.Uuid != "u1" {
+		t.Fatalf("GetMetadata returned %+v, %v", meta, err)
+	}
+
+	var listed []string
+	err = mirror.ListMetadata("", "tank/data", func(meta *Common.Metadata) {
+		listed = append(listed, meta.Uuid)
+	})
+	if err != nil || len(listed) != 1 || listed[0] != "u1" {
+		t.Fatalf("ListMetadata listed %v, %v", listed, err)
+	}
+
+	chunks, err := mirror.ListChunks("u1")
+	if err != nil || len(chunks) != 1 {
+		t.Fatalf("ListChunks returned %v, %v", chunks, err)
+	}
+	var got bytes.Buffer
+	_, err = mirror.GetChunk(chunks[0], &got)
+	if err != nil || !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("GetChunk returned %q, %v", got.Bytes(), err)
+	}
+}
+
+func TestMirrorGetChunkPartial(t *testing.T) {
+	mirror, _ := newTestMirror(t, []byte("part"))
+
+	chunks, err := mirror.Targets[1].Backend.ListChunks("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not listed by the mirror, so every target is asked for it by its id
+	var got bytes.Buffer
+	_, err = mirror.GetChunk(chunks[0], &got)
+	if err != errBroken {
+		t.Fatalf("GetChunk after a partial download returned %v", err)
+	}
+	if got.String() != "part" {
+		t.Errorf("GetChunk fell back after writing %q", got.String())
+	}
+}
+
+func TestMirrorGetLatest(t *testing.T) {
+	mirror, _ := newTestMirror(t, nil)
+
+	// Failed targets are set while other reads look at them
+	var wait sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			mirror.GetMetadata("u1")
+		}()
+	}
+	latest, err := mirror.GetLatest("tank/data")
+	wait.Wait()
+	if err != nil || latest == nil || latest.Uuid != "u1" {
+		t.Fatalf("GetLatest returned %v, %v", latest, err)
+	}
+
+	if mirror.Targets[0].Failed == nil || mirror.Targets[1].Failed != nil {
+		t.Errorf("targets failed: %v, %v", mirror.Targets[0].Failed, mirror.Targets[1].Failed)
+	}
+	if mirror.Report() != E_MIRROR_INCOMPLETE {
+		t.Errorf("Report does not tell about the broken target")
+	}
+
+	// The broken target is not read from anymore
+	meta, err := mirror.GetMetadata("u1")
+	if err != nil || meta.Uuid != "u1" {
+		t.Fatalf("GetMetadata returned %+v, %v", meta, err)
+	}
+}
+
+// prefixedIds prefixes the chunk ids of backend, as backends do not share their ids.
+type prefixedIds struct {
+	Common.Backend
+	prefix string
+	broken bool
+}
+
+func (this *prefixedIds) ListChunks(uuid string) ([]*Common.RemoteChunk, error) {
+	chunks, err := this.Backend.ListChunks(uuid)
+	for _, chunk := range chunks {
+		chunk.Id = this.prefix + chunk.Id
+	}
+	return chunks, err
+}
+
+func (this *prefixedIds) GetChunk(chunk *Common.RemoteChunk, writer io.Writer) (int64, error) {
+	if this.broken {
+		return 0, errBroken
+	}
+	if !strings.HasPrefix(chunk.Id, this.prefix) {
+		return 0, fmt.Errorf("no chunk with id %s", chunk.Id)
+	}
+	own := *chunk
+	own.Id = strings.TrimPrefix(chunk.Id, this.prefix)
+	return this.Backend.GetChunk(&own, writer)
+}
+
+func TestMirrorGetChunkOtherIds(t *testing.T) {
+	var targets []*MirrorTarget
+	data := []byte("chunk of u1")
+	for _, name := range []string{"drive", "nas"} {
+		backend := newLocalBackend(t)
+		info := &Common.ChunkInfo{Uuid: "u1", FileName: "tank/data@1", IsData: true, Chunk: 0}
+		err := backend.PutChunk(info, bytes.NewReader(data), fmt.Sprintf("%x", md5.Sum(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, &MirrorTarget{Name: name, Backend: &prefixedIds{Backend: backend, prefix: name + ":", broken: name == "drive"}})
+	}
+	mirror := NewMirror(targets)
+
+	chunks, err := mirror.ListChunks("u1")
+	if err != nil || len(chunks) != 1 || !strings.HasPrefix(chunks[0].Id, "drive:") {
+		t.Fatalf("ListChunks returned %v, %v", chunks, err)
+	}
+	var got bytes.Buffer
+	_, err = mirror.GetChunk(chunks[0], &got)
+	if err != nil || !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("GetChunk from the second target returned %q, %v", got.Bytes(), err)
+	}
+
+	// A chunk the target does not have is not read by the id of another target
+	_, err = mirror.GetChunk(&Common.RemoteChunk{Id: "drive:other", Chunk: 1}, ioutil.Discard)
+	if err == nil {
+		t.Errorf("GetChunk of an unknown chunk succeeded")
+	}
+}
@@ -0,0 +1,89 @@
+package Abstractions
+
+import (
+	"errors"
+	"sort"
+
+	"../Common"
+	"github.com/dustin/go-humanize"
+	"github.com/prometheus/common/log"
+)
+
+// Number of recent snapshots the compression ratio is taken from.
+const PREFLIGHT_SNAPSHOTS = 10
+
+// Estimates are rough. A backup only counts as not fitting if it exceeds the remaining
+// quota by more than this share.
+const PREFLIGHT_TOLERANCE = 0.1
+
+var E_QUOTA_INSUFFICIENT = errors.New("the backup will not fit into the remaining quota of the backend")
+
+// CompressionRatio returns the stored size per byte sent of the recent snapshots of subvolume,
+// or 1 if none of them recorded the size sent.
+func CompressionRatio(backend Common.Backend, fileType string, subvolume string) float64 {
+	var recent []*Common.Metadata
+	err := backend.ListMetadata(fileType, subvolume, func(meta *Common.Metadata) {
+		if meta.TotalSizeIn > 0 {
+			recent = append(recent, meta)
+		}
+	})
+	if err != nil {
+		log.Warnf("Could not list snapshots to estimate the compression ratio: %v", err)
+		return 1
+	}
+
+	sort.Slice(recent, func(i, j int) bool {
+		return recent[i].Date > recent[j].Date
+	})
+	if len(recent) > PREFLIGHT_SNAPSHOTS {
+		recent = recent[:PREFLIGHT_SNAPSHOTS]
+	}
+
+	var sent, stored uint64
+	for _, meta := range recent {
+		sent += meta.TotalSizeIn
+		stored += meta.TotalSize
+	}
+	if sent == 0 {
+		return 1
+	}
+	return float64(stored) / float64(sent)
+}
+
+// Preflight checks whether a snapshot of subvolume, estimated to send estimate bytes, fits
+// into the remaining quota of backend. It only fails if the backup clearly does not fit.
+// Without a quota or if it cannot be read, everything fits.
+func Preflight(backend Common.Backend, fileType string, subvolume string, estimate uint64) error {
+	quota, err := backend.Quota()
+	if err != nil {
+		log.Warnf("Skipping quota check, as the quota could not be read: %v", err)
+		return nil
+	}
+	if quota.Unlimited {
+		return nil
+	}
+
+	var remaining uint64
+	if quota.Limit > quota.Used {
+		remaining = quota.Limit - quota.Used
+	}
+
+	ratio := CompressionRatio(backend, fileType, subvolume)
+	expected := uint64(float64(estimate) * ratio)
+
+	log.Infof(
+		"Estimated upload: %s (%s sent at a compression ratio of %.2f). Remaining quota: %s",
+		humanize.IBytes(expected),
+		humanize.IBytes(estimate),
+		ratio,
+		humanize.IBytes(remaining),
+	)
+
+	if float64(expected)*(1-PREFLIGHT_TOLERANCE) > float64(remaining) {
+		return E_QUOTA_INSUFFICIENT
+	}
+	if expected > remaining {
+		log.Warnf("The backup might not fit into the remaining quota")
+	}
+	return nil
+}
@@ -2,7 +2,6 @@ package Abstractions
 
 import (
 	"../Common"
-	"../GoogleDrive"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -19,24 +18,29 @@ import (
 )
 
 type Uploader struct {
-	inputMeta   *GoogleDrive.MetadataBase
+	inputMeta   *Common.MetadataBase
 	multiWriter io.Writer
 	readProxy   *ReadProxy
 	compress    *lz4.Writer
+	sealer      *Common.Sealer
 	mac         hash.Hash
 	keyStream   cipher.Stream
-	uploader    *GoogleDrive.Writer
+	uploader    *ChunkWriter
+	backend     Common.Backend
 	timestamp   int64
 	iv          []byte
-	parent      string
+	keySlots    []Common.KeySlot
+	keyCheck    string
+	master      []byte
 	fileType    string
 	subvolume   string
 	Parent      string
 }
 
-func NewUploader(r io.ReadCloser, fileType string, subvolume string, folder string, filename string, passphrase string, encryption string, authentication string, chunksize int, tmpdir string) *Uploader {
+func NewUploader(r io.ReadCloser, backend Common.Backend, fileType string, subvolume string, filename string, keys *Common.Keys, encryption string, authentication string, chunksize int, tmpdir string, streaming bool, uploads int) *Uploader {
 	this := &Uploader{}
 
+	this.backend = backend
 	this.fileType = fileType
 	this.subvolume = subvolume
 
@@ -44,8 +48,6 @@ func NewUploader(r io.ReadCloser, fileType string, subvolume string, folder stri
 
 	var writers []io.Writer
 
-	this.parent = GoogleDrive.FindOrCreateFolder(folder)
-
 	id, _ := uuid.NewV4()
 
 	var writeTarget io.Writer
@@ -59,20 +61,39 @@ func NewUploader(r io.ReadCloser, fileType string, subvolume string, folder stri
 	encryptionL := strings.ToLower(encryption)
 	authenticationL := strings.ToLower(authentication)
 
-	this.inputMeta = &GoogleDrive.MetadataBase{Uuid: id.String(), FileName: filename, IsData: true, Authentication: authenticationL, Encryption: encryptionL}
+	this.inputMeta = &Common.MetadataBase{Uuid: id.String(), FileName: filename, IsData: true, Authentication: authenticationL, Encryption: encryptionL}
 
-	this.uploader, err = GoogleDrive.NewGoogleDriveWriter(this.inputMeta, this.parent, chunksize*1024*1024, tmpdir)
+	this.uploader, err = NewChunkWriter(this.backend, this.inputMeta, chunksize*1024*1024, tmpdir, streaming, uploads)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	authenticationKey, encryptionKey := Common.DeriveKeys([]byte(passphrase), this.iv)
-
-	this.mac, this.keyStream = Common.PrepareMACAndEncryption(authenticationKey, encryptionKey, this.iv, this.inputMeta.Authentication, this.inputMeta.Encryption, false)
+	master, keySlots, err := keys.NewSnapshotKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	this.keySlots = keySlots
+	this.keyCheck = Common.KeyCheck(master, this.iv)
+	this.master = master
+	authenticationKey, encryptionKey := Common.DeriveKeys(master, this.iv)
+
+	streamEncryption := this.inputMeta.Encryption
+	if Common.IsAEAD(streamEncryption) {
+		streamEncryption = "none"
+	}
+	this.mac, this.keyStream = Common.PrepareMACAndEncryption(authenticationKey, encryptionKey, this.iv, this.inputMeta.Authentication, streamEncryption, false)
 	if this.mac != nil {
 		writers = append(writers, this.mac)
 	}
-	if this.keyStream == nil {
+	if Common.IsAEAD(this.inputMeta.Encryption) {
+		aead, err := Common.NewAEAD(encryptionKey, this.inputMeta.Encryption)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Encryption enabled .....: %s, sealed per block", strings.ToUpper(this.inputMeta.Encryption))
+		this.sealer = Common.NewSealer(aead, this.inputMeta.Uuid, chunksize*1024*1024, this.uploader)
+		writeTarget = this.sealer
+	} else if this.keyStream == nil {
 		writeTarget = this.uploader
 	} else {
 		writeTarget = cipher.StreamWriter{S: this.keyStream, W: this.uploader, Err: nil}
@@ -98,11 +119,19 @@ func NewUploader(r io.ReadCloser, fileType string, subvolume string, folder stri
 
 func (this *Uploader) close() (error, error) {
 	err := this.compress.Close()
+	if this.sealer != nil {
+		// Without the final block the snapshot cannot be restored
+		err2 := this.sealer.Close()
+		if err2 != nil {
+			this.uploader.Close()
+			return err, err2
+		}
+	}
 	err2 := this.uploader.Close()
 	return err, err2
 }
 
-func (this *Uploader) Upload() (*GoogleDrive.Metadata, error) {
+func (this *Uploader) Upload() (*Common.Metadata, error) {
 	log.Infof("Uploading as '%s'", this.inputMeta.Uuid)
 
 	// Here the actual reading and upload begins
@@ -117,6 +146,8 @@ func (this *Uploader) Upload() (*GoogleDrive.Metadata, error) {
 	}
 	if err2 != nil {
 		log.Errorln( err2)
+		// Without all chunks the snapshot must not show up on the backend
+		return nil, err2
 	}
 
 	var authHMAC string
@@ -124,7 +155,14 @@ func (this *Uploader) Upload() (*GoogleDrive.Metadata, error) {
 		authHMAC = fmt.Sprintf("%x", this.mac.Sum(nil))
 	}
 
-	meta := &GoogleDrive.Metadata{
+	format := uint(Common.FORMAT_STREAM)
+	var chunkSize uint64
+	if this.sealer != nil {
+		format = Common.FORMAT_SEALED
+		chunkSize = uint64(this.uploader.cacheSize)
+	}
+
+	meta := &Common.Metadata{
 		HMAC:           authHMAC,
 		IV:             fmt.Sprintf("%x", this.iv),
 		FileName:       this.inputMeta.FileName,
@@ -138,7 +176,12 @@ func (this *Uploader) Upload() (*GoogleDrive.Metadata, error) {
 		Subvolume:      this.subvolume,
 		Date:           this.timestamp,
 		Parent:         this.Parent,
+		Format:         format,
+		ChunkSize:      chunkSize,
+		KeySlots:       this.keySlots,
+		KeyCheck:       this.keyCheck,
 	}
+	meta.ParametersCheck = Common.ParametersCheck(this.master, meta)
 
 	//Print summary:
 	fmt.Fprintf(
@@ -159,15 +202,14 @@ func (this *Uploader) Upload() (*GoogleDrive.Metadata, error) {
 		meta.Chunks,
 	)
 
-	for {
-		log.Info("Uploading metadata...")
-		if GoogleDrive.UploadMetadata(meta, this.parent) != nil {
-			log.Info("Metadata uploaded")
-			break
-		}
-		log.Warn(os.Stderr, "Failed to upload metadata. Retrying...")
-		time.Sleep(5 * time.Second)
+	log.Info("Uploading metadata...")
+	err2 = Common.DefaultRetry.Do("Upload of metadata", func() error {
+		return this.backend.PutMetadata(meta)
+	}, this.backend)
+	if err2 != nil {
+		return nil, err2
 	}
+	log.Info("Metadata uploaded")
 
 	return meta, err
 }
@@ -2,7 +2,6 @@ package Btrfs
 
 import (
 	"../Common"
-	"../GoogleDrive"
 	"bytes"
 	"fmt"
 	"hash/crc32"
@@ -26,6 +25,13 @@ var btrfsSnapshotRegExp = regexp.MustCompile(`([^\s]+?)$`)
 
 var snapshotdir = "/var/backups/snapshots"
 
+/*
+inode 257 file offset 0 len 4096 disk start 13631488 offset 0 gen 358 flags NONE etc/hostname
+transid marker was 358
+*/
+var btrfsExtentRegExp = regexp.MustCompile(`file offset \d+ len (\d+)`)
+var btrfsTransidRegExp = regexp.MustCompile(`transid marker was (\d+)`)
+
 type Manager struct {
 	Common.SnapshotManager
 	parent string
@@ -33,7 +39,7 @@ type Manager struct {
 
 func NewManager(folder string) *Manager {
 	this := &Manager{}
-	this.parent = GoogleDrive.FindOrCreateFolder(folder)
+	this.parent = folder
 	return this
 }
 
@@ -178,6 +184,65 @@ func (this *Manager) Stream(snapshot string, parentSnapshot string) (io.ReadClos
 	return rc, nil
 }
 
+func btrfsOutput(args ...string) (string, error) {
+	cmd := exec.Command("btrfs", args...)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+// EstimateSize works without a snapshot, as btrfs send only sends read-only snapshots.
+// A full stream is about the size of the subvolume. An incremental one is about the size
+// of the extents written since the generation of the parent.
+func (this *Manager) EstimateSize(subvolume string, parentSnapshot string) (uint64, error) {
+	if parentSnapshot == "" {
+		out, err := btrfsOutput("filesystem", "du", "-s", "--raw", subvolume)
+		if err != nil {
+			return 0, err
+		}
+		// Below the header: Total, Exclusive, Set shared, Filename
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		fields := strings.Fields(lines[len(lines)-1])
+		if len(lines) < 2 || len(fields) == 0 {
+			return 0, fmt.Errorf("unexpected output of btrfs filesystem du: %s", out)
+		}
+		return strconv.ParseUint(fields[0], 10, 64)
+	}
+
+	// A generation newer than any only prints the generation of the parent
+	out, err := btrfsOutput("subvolume", "find-new", parentSnapshot, strconv.FormatUint(^uint64(0)>>1, 10))
+	if err != nil {
+		return 0, err
+	}
+	matches := btrfsTransidRegExp.FindStringSubmatch(out)
+	if matches == nil {
+		return 0, fmt.Errorf("unexpected output of btrfs subvolume find-new: %s", out)
+	}
+
+	out, err = btrfsOutput("subvolume", "find-new", subvolume, matches[1])
+	if err != nil {
+		return 0, err
+	}
+
+	var size uint64
+	for _, extent := range btrfsExtentRegExp.FindAllStringSubmatch(out, -1) {
+		length, err := strconv.ParseUint(extent[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		size += length
+	}
+
+	return size, nil
+}
+
 func (this *Manager) Restore(targetSubvolume string) (io.WriteCloser, error) {
 	os.MkdirAll(targetSubvolume, 0644)
 	command := exec.Command("btrfs", "receive", targetSubvolume)
@@ -0,0 +1,79 @@
+package Common
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	E_NO_LATEST             = errors.New("no latest found")
+	E_NO_METADATA           = errors.New("no metadata found")
+	E_BACKEND_HASH_MISMATCH = errors.New("hash of remote file differs from local file")
+	E_NO_STREAMING          = errors.New("backend cannot stream chunks")
+	E_NO_QUARANTINE         = errors.New("backend cannot quarantine snapshots")
+	E_APPEND_ONLY           = errors.New("refusing to delete or move files with append-only credentials. This needs the admin credentials")
+)
+
+// Backend is a storage target for one backup folder.
+// It stores the chunks of a snapshot (`<uuid>|<n>`), its metadata (`<uuid>|M`)
+// and a "latest" pointer per subvolume (`<subvolume>|latest`).
+type Backend interface {
+	// PutChunk stores a chunk. If wantedMD5 is not empty, the backend has to
+	// verify the stored data against it and return E_BACKEND_HASH_MISMATCH otherwise.
+	PutChunk(info *ChunkInfo, reader io.Reader, wantedMD5 string) error
+	// ListChunks returns all chunks stored for a snapshot in no particular order.
+	// MD5 may be empty until the chunk was read with GetChunk, see ChunkHasher.
+	ListChunks(uuid string) ([]*RemoteChunk, error)
+	// GetChunk writes the content of a chunk to writer. It may set the MD5 of chunk.
+	GetChunk(chunk *RemoteChunk, writer io.Writer) (int64, error)
+
+	PutMetadata(meta *Metadata) error
+	// GetMetadata returns E_NO_METADATA if there is no metadata for uuid.
+	GetMetadata(uuid string) (*Metadata, error)
+	// ListMetadata calls callback for every snapshot in the folder, optionally
+	// filtered by fileType and subvolume. Only the indexed fields are guaranteed
+	// to be set. HMAC and IV may be empty, TotalSizeIn is 0 for older snapshots.
+	// Backends have to page through all results.
+	ListMetadata(fileType string, subvolume string, callback func(*Metadata)) error
+
+	// GetLatest returns nil if no snapshot was uploaded for subvolume yet.
+	GetLatest(subvolume string) (*Snapshot, error)
+	SetLatest(subvolume string, latest *Snapshot) error
+
+	// ListUuids returns the uuid of every snapshot with at least one file in the folder.
+	ListUuids() ([]string, error)
+	// Delete removes every file belonging to the snapshot uuid.
+	Delete(uuid string) error
+
+	Quota() (*Quota, error)
+}
+
+// ChunkStreamer is implemented by backends that can store a chunk straight from a
+// stream, without knowing its size or MD5 beforehand.
+type ChunkStreamer interface {
+	// StreamChunk stores everything read from reader as a chunk and returns the
+	// MD5 of what the backend stored.
+	StreamChunk(info *ChunkInfo, reader io.Reader) (string, error)
+}
+
+// ChunkHasher is implemented by backends whose ListChunks cannot return the MD5 of
+// every chunk without a request per chunk.
+type ChunkHasher interface {
+	// ChunkMD5 returns the MD5 the backend stored for chunk.
+	ChunkMD5(chunk *RemoteChunk) (string, error)
+}
+
+// Quarantiner is implemented by backends that can set a snapshot aside instead of deleting it.
+// Quarantined files are not listed anymore, until they are restored or purged.
+type Quarantiner interface {
+	// Quarantine moves every file belonging to the snapshot uuid into quarantine.
+	Quarantine(uuid string) error
+	// ListQuarantined returns when each quarantined snapshot was quarantined.
+	ListQuarantined() (map[string]time.Time, error)
+	// RestoreQuarantined moves the files of a quarantined snapshot back. Files that exist
+	// again in the meantime, e.g. a newer latest pointer, are kept.
+	RestoreQuarantined(uuid string) error
+	// Purge deletes the quarantined files of a snapshot for good.
+	Purge(uuid string) error
+}
@@ -0,0 +1,231 @@
+package Common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/prometheus/common/log"
+)
+
+// Transfers are paced in pieces of this size, so the rate stays smooth.
+const BANDWIDTH_PIECE = 32 * 1024
+
+var E_INVALID_SCHEDULE = errors.New("invalid bandwidth schedule. Expected e.g. '5MiB' or '08:00-20:00 2MiB,10MiB'")
+
+// Set from the command line and shared by all transfers in the same direction.
+var (
+	// Limits what is sent to backends. nil for no limit.
+	UploadLimiter *Limiter
+	// Limits what is received from backends. nil for no limit.
+	DownloadLimiter *Limiter
+)
+
+type scheduleEntry struct {
+	// Minutes since midnight. Ranges may wrap around midnight.
+	from  int
+	to    int
+	limit uint64
+}
+
+// BandwidthSchedule is a rate limit in bytes per second that depends on the time of day.
+type BandwidthSchedule struct {
+	entries []scheduleEntry
+	// Applies outside of all entries. 0 for no limit.
+	fallback uint64
+}
+
+// parseClock returns the minutes since midnight of "hh:mm". "24:00" is the end of the day.
+func parseClock(clock string) (int, error) {
+	var hours, minutes int
+	_, err := fmt.Sscanf(clock, "%d:%d", &hours, &minutes)
+	if err != nil || hours < 0 || hours > 24 || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, E_INVALID_SCHEDULE
+	}
+	return hours*60 + minutes, nil
+}
+
+func parseRate(rate string) (uint64, error) {
+	rate = strings.TrimSuffix(strings.TrimSpace(rate), "/s")
+	if rate == "unlimited" || rate == "0" {
+		return 0, nil
+	}
+	limit, err := humanize.ParseBytes(rate)
+	if err != nil {
+		return 0, E_INVALID_SCHEDULE
+	}
+	return limit, nil
+}
+
+// ParseBandwidthSchedule reads a comma separated list of "<from>-<to> <rate>" entries
+// and an optional rate for all other times, e.g. "08:00-20:00 2MiB,unlimited".
+// Without it, there is no limit outside of the entries.
+func ParseBandwidthSchedule(spec string) (*BandwidthSchedule, error) {
+	schedule := &BandwidthSchedule{}
+
+	for _, part := range strings.Split(spec, ",") {
+		fields := strings.Fields(part)
+		switch len(fields) {
+		case 1:
+			limit, err := parseRate(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			schedule.fallback = limit
+		case 2:
+			clocks := strings.Split(fields[0], "-")
+			if len(clocks) != 2 {
+				return nil, E_INVALID_SCHEDULE
+			}
+			from, err := parseClock(clocks[0])
+			if err != nil {
+				return nil, err
+			}
+			to, err := parseClock(clocks[1])
+			if err != nil {
+				return nil, err
+			}
+			limit, err := parseRate(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			schedule.entries = append(schedule.entries, scheduleEntry{from: from, to: to, limit: limit})
+		default:
+			return nil, E_INVALID_SCHEDULE
+		}
+	}
+
+	return schedule, nil
+}
+
+// Limit returns the limit at now. The first matching entry wins.
+func (this *BandwidthSchedule) Limit(now time.Time) uint64 {
+	minute := now.Hour()*60 + now.Minute()
+	for _, entry := range this.entries {
+		if entry.from <= entry.to && minute >= entry.from && minute < entry.to {
+			return entry.limit
+		}
+		if entry.from > entry.to && (minute >= entry.from || minute < entry.to) {
+			return entry.limit
+		}
+	}
+	return this.fallback
+}
+
+// Limiter paces all transfers passing through it to the limit of its schedule.
+// Every piece reserves its slot in time, so parallel transfers share the limit.
+type Limiter struct {
+	name      string
+	schedule  *BandwidthSchedule
+	lock      sync.Mutex
+	next      time.Time
+	lastLimit uint64
+	logged    bool
+}
+
+func NewLimiter(name string, schedule *BandwidthSchedule) *Limiter {
+	return &Limiter{name: name, schedule: schedule}
+}
+
+// Wait blocks until n more bytes may be transferred.
+func (this *Limiter) Wait(n int) {
+	this.lock.Lock()
+	now := time.Now()
+	limit := this.schedule.Limit(now)
+	if !this.logged || limit != this.lastLimit {
+		if limit == 0 {
+			log.Infof("%s bandwidth is not limited", this.name)
+		} else {
+			log.Infof("%s bandwidth is limited to %s/s", this.name, humanize.IBytes(limit))
+		}
+		this.lastLimit = limit
+		this.logged = true
+	}
+	if limit == 0 {
+		this.next = now
+		this.lock.Unlock()
+		return
+	}
+
+	// Time not used before is not saved up for bursts
+	if this.next.Before(now) {
+		this.next = now
+	}
+	wait := this.next.Sub(now)
+	this.next = this.next.Add(time.Duration(float64(n) / float64(limit) * float64(time.Second)))
+	this.lock.Unlock()
+
+	time.Sleep(wait)
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	limiter *Limiter
+}
+
+func (this *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > BANDWIDTH_PIECE {
+		p = p[:BANDWIDTH_PIECE]
+	}
+	n, err := this.reader.Read(p)
+	this.limiter.Wait(n)
+	return n, err
+}
+
+// Backends check for io.Seeker, e.g. to resume uploads
+type limitedReadSeeker struct {
+	*limitedReader
+	seeker io.Seeker
+}
+
+func (this *limitedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return this.seeker.Seek(offset, whence)
+}
+
+// Reader paces reads from reader. It keeps reader seekable.
+func (this *Limiter) Reader(reader io.Reader) io.Reader {
+	if this == nil {
+		return reader
+	}
+
+	limited := &limitedReader{reader: reader, limiter: this}
+	if seeker, ok := reader.(io.Seeker); ok {
+		return &limitedReadSeeker{limited, seeker}
+	}
+	return limited
+}
+
+type limitedWriter struct {
+	writer  io.Writer
+	limiter *Limiter
+}
+
+func (this *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		piece := p
+		if len(piece) > BANDWIDTH_PIECE {
+			piece = piece[:BANDWIDTH_PIECE]
+		}
+		this.limiter.Wait(len(piece))
+		n, err := this.writer.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Writer paces writes to writer.
+func (this *Limiter) Writer(writer io.Writer) io.Writer {
+	if this == nil {
+		return writer
+	}
+	return &limitedWriter{writer: writer, limiter: this}
+}
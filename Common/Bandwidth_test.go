@@ -0,0 +1,55 @@
+package Common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseClock(t *testing.T) {
+	for clock, want := range map[string]int{"00:00": 0, "08:30": 510, "23:59": 1439, "24:00": 1440} {
+		got, err := parseClock(clock)
+		if err != nil || got != want {
+			t.Errorf("parseClock(%q) = %d, %v, want %d", clock, got, err, want)
+		}
+	}
+
+	for _, clock := range []string{"24:30", "24:01", "25:00", "12:60", "-1:00", "noon"} {
+		_, err := parseClock(clock)
+		if err != E_INVALID_SCHEDULE {
+			t.Errorf("parseClock(%q) returned %v", clock, err)
+		}
+	}
+}
+
+func TestBandwidthSchedule(t *testing.T) {
+	schedule, err := ParseBandwidthSchedule("08:00-20:00 2MiB, 22:00-06:00 unlimited, 20:00-24:00 1MiB, 10MiB")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for clock, want := range map[string]uint64{
+		"07:59": 10 * 1024 * 1024,
+		"08:00": 2 * 1024 * 1024,
+		"19:59": 2 * 1024 * 1024,
+		"20:00": 1024 * 1024,
+		"21:59": 1024 * 1024,
+		"22:00": 0,
+		"05:59": 0,
+		"06:00": 10 * 1024 * 1024,
+	} {
+		now, err := time.Parse("15:04", clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := schedule.Limit(now); got != want {
+			t.Errorf("limit at %s is %d, want %d", clock, got, want)
+		}
+	}
+
+	for _, spec := range []string{"24:30-08:00 1MiB", "08:00 1MiB", "08:00-20:00 fast", "1MiB 2MiB 3MiB"} {
+		_, err = ParseBandwidthSchedule(spec)
+		if err != E_INVALID_SCHEDULE {
+			t.Errorf("ParseBandwidthSchedule(%q) returned %v", spec, err)
+		}
+	}
+}
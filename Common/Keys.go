@@ -0,0 +1,454 @@
+package Common
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/sha3"
+)
+
+// Types of key slots.
+const (
+	// The data key is wrapped with a key derived from a passphrase.
+	KEY_SLOT_PASSPHRASE = "passphrase"
+	// The data key is wrapped for an X25519 public key, like age does.
+	KEY_SLOT_X25519 = "x25519"
+)
+
+// Keys are written as these prefixes followed by base64 (URL alphabet, no padding).
+const (
+	PUBLIC_KEY_PREFIX = "ozb-pub-"
+	SECRET_KEY_PREFIX = "OZB-SECRET-KEY-"
+)
+
+var (
+	E_INVALID_KEY  = errors.New("not a valid OZB public or secret key")
+	E_NO_IDENTITY  = errors.New("snapshot is encrypted to public keys. Specify --identity with one of their private keys")
+	E_NO_KEY_SLOTS = errors.New("wrong passphrase or key: none of the key slots of the snapshot opens with it")
+	E_WRONG_KEY    = errors.New("wrong passphrase or key: it does not match the key check value of the snapshot")
+	E_PARAMETERS   = errors.New("format, encryption or authentication of the snapshot do not match its parameter check. The metadata has been tampered with")
+	E_LEGACY_KEY   = errors.New("snapshot was uploaded before key slots. Its keys are derived from the passphrase directly and cannot be changed")
+	E_LAST_SLOT    = errors.New("refusing to remove the last key slot of the snapshot")
+	E_INVALID_KDF  = errors.New("invalid passphrase stretching parameters")
+)
+
+// Argon2 holds the Argon2id parameters a passphrase is stretched with.
+type Argon2 struct {
+	Time uint32
+	// In KiB
+	Memory  uint32
+	Threads uint8
+}
+
+// DefaultArgon2 takes a few hundred milliseconds and 64 MiB per passphrase and snapshot.
+var DefaultArgon2 = Argon2{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// Upper bounds of the Argon2id parameters. The parameters of a slot come from metadata on
+// the backend, so without them a modified slot could make a restore allocate any memory.
+const (
+	ARGON2_MAX_TIME = 64
+	// 4 GiB in KiB
+	ARGON2_MAX_MEMORY = 4 * 1024 * 1024
+)
+
+// Validate returns E_INVALID_KDF if the parameters are outside of what Argon2id accepts or
+// what a restore is allowed to spend.
+func (this *Argon2) Validate() error {
+	if this.Time < 1 || this.Threads < 1 || this.Memory < 8*uint32(this.Threads) {
+		return E_INVALID_KDF
+	}
+	if this.Time > ARGON2_MAX_TIME || this.Memory > ARGON2_MAX_MEMORY {
+		return E_INVALID_KDF
+	}
+	return nil
+}
+
+// KeySlot holds the data key of a snapshot, wrapped with one key encryption key.
+// Binary values are hex encoded, like the IV.
+type KeySlot struct {
+	Type string
+	// Random salt of the passphrase, for KEY_SLOT_PASSPHRASE
+	Salt string `json:",omitempty"`
+	// How the passphrase was stretched, for KEY_SLOT_PASSPHRASE. Not stretched if nil
+	Argon2 *Argon2 `json:",omitempty"`
+	// Public key of the one-time key pair the slot was wrapped with
+	Ephemeral string `json:",omitempty"`
+	// The data key, encrypted with ChaCha20-Poly1305 under the key encryption key
+	WrappedKey string
+}
+
+// Keys is what snapshots are encrypted and decrypted with.
+// The keys of new snapshots are derived from a random data key, which is only stored
+// wrapped in key slots. Without recipients it is wrapped with the passphrase. With
+// recipients it is wrapped for each of them instead, so the host uploading does not
+// need to be able to decrypt.
+type Keys struct {
+	Passphrase string
+	// X25519 public keys new snapshots are encrypted to
+	Recipients [][]byte
+	// X25519 private keys, to decrypt snapshots that were encrypted to public keys
+	Identities [][]byte
+	// Stretching of the passphrase in new slots. DefaultArgon2 if zero
+	Argon2 Argon2
+}
+
+// KeyCheck returns the value stored in the metadata to tell whether master is the key of the
+// snapshot with iv, before any chunk is downloaded. It is derived separately, so it tells
+// nothing about the keys themselves.
+func KeyCheck(master []byte, iv []byte) string {
+	derivationFunction := hkdf.New(sha3.New512, master, iv, []byte("OZB key check"))
+
+	check := make([]byte, 32)
+	_, err := io.ReadFull(derivationFunction, check)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(check)
+}
+
+// ParametersCheck returns the value stored in the metadata to authenticate how the snapshot
+// was uploaded. Without it, the format, encryption and authentication could be changed on
+// the backend to make a download skip decryption or authentication.
+func ParametersCheck(master []byte, meta *Metadata) string {
+	iv, _ := hex.DecodeString(meta.IV)
+	derivationFunction := hkdf.New(sha3.New512, master, iv, []byte("OZB parameters check"))
+
+	key := make([]byte, 64)
+	_, err := io.ReadFull(derivationFunction, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mac := hmac.New(sha3.New512, key)
+	// Every field is terminated, so no two sets of values give the same input
+	fmt.Fprintf(mac, "%s\x00%d\x00%s\x00%s\x00%d\x00", meta.Uuid, meta.Format, meta.Encryption, meta.Authentication, meta.ChunkSize)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// GenerateKeyPair returns a new X25519 private key and its public key.
+func GenerateKeyPair() (secret []byte, public []byte, err error) {
+	secret = make([]byte, curve25519.ScalarSize)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	public, err = curve25519.X25519(secret, curve25519.Basepoint)
+	return secret, public, err
+}
+
+func EncodePublicKey(public []byte) string {
+	return PUBLIC_KEY_PREFIX + base64.RawURLEncoding.EncodeToString(public)
+}
+
+func EncodeSecretKey(secret []byte) string {
+	return SECRET_KEY_PREFIX + base64.RawURLEncoding.EncodeToString(secret)
+}
+
+func decodeKey(key string, prefix string) ([]byte, error) {
+	if !strings.HasPrefix(key, prefix) {
+		return nil, E_INVALID_KEY
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(key, prefix))
+	if err != nil || len(raw) != curve25519.PointSize {
+		return nil, E_INVALID_KEY
+	}
+	return raw, nil
+}
+
+func ParsePublicKey(key string) ([]byte, error) {
+	return decodeKey(strings.TrimSpace(key), PUBLIC_KEY_PREFIX)
+}
+
+// ReadIdentityFile reads the private keys of a file written by --keygen.
+// Empty lines and lines starting with '#' are skipped.
+func ReadIdentityFile(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var identities [][]byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		secret, err := decodeKey(line, SECRET_KEY_PREFIX)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, secret)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(identities) == 0 {
+		return nil, E_INVALID_KEY
+	}
+	return identities, nil
+}
+
+// x25519WrapKey derives the key encryption key shared by ephemeral and recipient.
+func x25519WrapKey(shared []byte, ephemeral []byte, recipient []byte) []byte {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	derivationFunction := hkdf.New(sha256.New, shared, salt, []byte("OZB X25519"))
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err := io.ReadFull(derivationFunction, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// wrap encrypts dataKey with a key only used once, so the nonce can be fixed.
+func wrap(wrapKey []byte, dataKey []byte) (string, error) {
+	aead, err := chacha20poly1305.New(wrapKey)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(aead.Seal(nil, make([]byte, aead.NonceSize()), dataKey, nil)), nil
+}
+
+func unwrap(wrapKey []byte, wrapped string) ([]byte, error) {
+	aead, err := chacha20poly1305.New(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), raw, nil)
+}
+
+// passphraseWrapKey derives the key encryption key of a passphrase slot. The passphrase is
+// stretched first, so guessing it costs stretching time and memory for every guess.
+func passphraseWrapKey(passphrase string, salt []byte, stretching *Argon2) ([]byte, error) {
+	master := []byte(passphrase)
+	if stretching != nil {
+		err := stretching.Validate()
+		if err != nil {
+			return nil, err
+		}
+		master = argon2.IDKey(master, salt, stretching.Time, stretching.Memory, stretching.Threads, 32)
+	}
+	derivationFunction := hkdf.New(sha3.New512, master, salt, []byte("OZB key slot"))
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err := io.ReadFull(derivationFunction, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key, nil
+}
+
+func wrapPassphrase(passphrase string, stretching Argon2, dataKey []byte) (*KeySlot, error) {
+	salt := make([]byte, 32)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapKey, err := passphraseWrapKey(passphrase, salt, &stretching)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := wrap(wrapKey, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &KeySlot{Type: KEY_SLOT_PASSPHRASE, Salt: hex.EncodeToString(salt), Argon2: &stretching, WrappedKey: wrapped}, nil
+}
+
+func unwrapPassphrase(passphrase string, slot *KeySlot) ([]byte, error) {
+	salt, err := hex.DecodeString(slot.Salt)
+	if err != nil {
+		return nil, err
+	}
+	wrapKey, err := passphraseWrapKey(passphrase, salt, slot.Argon2)
+	if err != nil {
+		return nil, err
+	}
+	return unwrap(wrapKey, slot.WrappedKey)
+}
+
+func wrapX25519(recipient []byte, dataKey []byte) (*KeySlot, error) {
+	secret, ephemeral, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(secret, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := wrap(x25519WrapKey(shared, ephemeral, recipient), dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &KeySlot{Type: KEY_SLOT_X25519, Ephemeral: hex.EncodeToString(ephemeral), WrappedKey: wrapped}, nil
+}
+
+func unwrapX25519(identity []byte, slot *KeySlot) ([]byte, error) {
+	ephemeral, err := hex.DecodeString(slot.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := curve25519.X25519(identity, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(identity, ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	return unwrap(x25519WrapKey(shared, ephemeral, recipient), slot.WrappedKey)
+}
+
+// slots wraps dataKey with the passphrase, if given, and for every recipient.
+func slots(dataKey []byte, passphrase string, stretching Argon2, recipients [][]byte) ([]KeySlot, error) {
+	var slots []KeySlot
+	if stretching == (Argon2{}) {
+		stretching = DefaultArgon2
+	}
+	if passphrase != "" {
+		slot, err := wrapPassphrase(passphrase, stretching, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, *slot)
+	}
+	for _, recipient := range recipients {
+		slot, err := wrapX25519(recipient, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, *slot)
+	}
+	return slots, nil
+}
+
+// NewSnapshotKey returns the master key the keys of a new snapshot are derived from,
+// and the slots to store in its metadata.
+func (this *Keys) NewSnapshotKey() ([]byte, []KeySlot, error) {
+	if this.Passphrase == "" && len(this.Recipients) == 0 {
+		return []byte(this.Passphrase), nil, nil
+	}
+
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	passphrase := this.Passphrase
+	if len(this.Recipients) > 0 {
+		// Otherwise hosts with --hidemetadata could decrypt their backups again
+		passphrase = ""
+	}
+	slots, err := slots(dataKey, passphrase, this.Argon2, this.Recipients)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, slots, nil
+}
+
+// open returns the data key in slot, if one of the keys opens it.
+func (this *Keys) open(slot *KeySlot) ([]byte, error) {
+	switch slot.Type {
+	case KEY_SLOT_PASSPHRASE:
+		if this.Passphrase != "" {
+			return unwrapPassphrase(this.Passphrase, slot)
+		}
+	case KEY_SLOT_X25519:
+		for _, identity := range this.Identities {
+			dataKey, err := unwrapX25519(identity, slot)
+			if err == nil {
+				return dataKey, nil
+			}
+		}
+	}
+	return nil, E_NO_KEY_SLOTS
+}
+
+// Unlock returns the master key of the snapshot described by meta.
+func (this *Keys) Unlock(meta *Metadata) ([]byte, error) {
+	if len(meta.KeySlots) == 0 {
+		return []byte(this.Passphrase), nil
+	}
+
+	onlyX25519 := true
+	for i := range meta.KeySlots {
+		dataKey, err := this.open(&meta.KeySlots[i])
+		if err == nil {
+			return dataKey, nil
+		}
+		onlyX25519 = onlyX25519 && meta.KeySlots[i].Type == KEY_SLOT_X25519
+	}
+	if onlyX25519 && len(this.Identities) == 0 {
+		return nil, E_NO_IDENTITY
+	}
+	return nil, E_NO_KEY_SLOTS
+}
+
+// Opens tells which slots of meta the keys open.
+func (this *Keys) Opens(meta *Metadata) []bool {
+	opens := make([]bool, len(meta.KeySlots))
+	for i := range meta.KeySlots {
+		_, err := this.open(&meta.KeySlots[i])
+		opens[i] = err == nil
+	}
+	return opens
+}
+
+// AddKeySlots unlocks meta with the keys and adds slots for the passphrase and
+// recipients of add.
+func (this *Keys) AddKeySlots(meta *Metadata, add *Keys) error {
+	if len(meta.KeySlots) == 0 {
+		return E_LEGACY_KEY
+	}
+	dataKey, err := this.Unlock(meta)
+	if err != nil {
+		return err
+	}
+
+	added, err := slots(dataKey, add.Passphrase, add.Argon2, add.Recipients)
+	if err != nil {
+		return err
+	}
+	meta.KeySlots = append(meta.KeySlots, added...)
+	return nil
+}
+
+// RemoveKeySlots removes the slots of meta the keys open and returns how many.
+func (this *Keys) RemoveKeySlots(meta *Metadata) (int, error) {
+	var kept []KeySlot
+	for i, opens := range this.Opens(meta) {
+		if !opens {
+			kept = append(kept, meta.KeySlots[i])
+		}
+	}
+
+	removed := len(meta.KeySlots) - len(kept)
+	if removed > 0 && len(kept) == 0 {
+		return 0, E_LAST_SLOT
+	}
+	meta.KeySlots = kept
+	return removed, nil
+}
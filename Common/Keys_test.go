@@ -0,0 +1,230 @@
+package Common
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Stretching that keeps the tests fast
+var testArgon2 = Argon2{Time: 1, Memory: 64, Threads: 1}
+
+func generateKeyPair(t *testing.T) ([]byte, []byte) {
+	secret, public, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret, public
+}
+
+func TestRecipients(t *testing.T) {
+	firstSecret, firstPublic := generateKeyPair(t)
+	secondSecret, secondPublic := generateKeyPair(t)
+	otherSecret, _ := generateKeyPair(t)
+
+	// The passphrase of a host with --hidemetadata must not open its backups
+	keys := &Keys{Passphrase: "passphrase", Recipients: [][]byte{firstPublic, secondPublic}, Argon2: testArgon2}
+	dataKey, slots, err := keys.NewSnapshotKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slots) != 2 || slots[0].Type != KEY_SLOT_X25519 || slots[1].Type != KEY_SLOT_X25519 {
+		t.Fatalf("NewSnapshotKey returned slots %+v", slots)
+	}
+	meta := &Metadata{KeySlots: slots}
+
+	for name, identity := range map[string][]byte{"first": firstSecret, "second": secondSecret} {
+		unlocked, err := (&Keys{Identities: [][]byte{otherSecret, identity}}).Unlock(meta)
+		if err != nil || !bytes.Equal(unlocked, dataKey) {
+			t.Errorf("%s identity unlocked %x, %v", name, unlocked, err)
+		}
+	}
+
+	for name, test := range map[string]struct {
+		keys *Keys
+		err  error
+	}{
+		"other identity": {&Keys{Identities: [][]byte{otherSecret}}, E_NO_KEY_SLOTS},
+		"passphrase":     {&Keys{Passphrase: "passphrase"}, E_NO_IDENTITY},
+		"nothing":        {&Keys{}, E_NO_IDENTITY},
+	} {
+		_, err := test.keys.Unlock(meta)
+		if err != test.err {
+			t.Errorf("unlocking with %s returned %v, want %v", name, err, test.err)
+		}
+	}
+}
+
+// Ephemeral keys are not reused, so the slots of two snapshots for the same recipient differ
+func TestRecipientSlotsDiffer(t *testing.T) {
+	_, public := generateKeyPair(t)
+	keys := &Keys{Recipients: [][]byte{public}}
+
+	_, first, err := keys.NewSnapshotKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, err := keys.NewSnapshotKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first[0].Ephemeral == second[0].Ephemeral || first[0].WrappedKey == second[0].WrappedKey {
+		t.Errorf("two snapshots share an ephemeral key")
+	}
+}
+
+func TestEncodedKeys(t *testing.T) {
+	secret, public := generateKeyPair(t)
+
+	parsed, err := ParsePublicKey(" " + EncodePublicKey(public) + "\n")
+	if err != nil || !bytes.Equal(parsed, public) {
+		t.Errorf("ParsePublicKey returned %x, %v", parsed, err)
+	}
+	for _, key := range []string{"", EncodeSecretKey(secret), PUBLIC_KEY_PREFIX + "AAAA", PUBLIC_KEY_PREFIX + "!!"} {
+		_, err = ParsePublicKey(key)
+		if err != E_INVALID_KEY {
+			t.Errorf("ParsePublicKey(%q) returned %v", key, err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "ozbkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "identity")
+	err = ioutil.WriteFile(file, []byte("# public key: "+EncodePublicKey(public)+"\n\n"+EncodeSecretKey(secret)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := ReadIdentityFile(file)
+	if err != nil || len(identities) != 1 || !bytes.Equal(identities[0], secret) {
+		t.Errorf("ReadIdentityFile returned %x, %v", identities, err)
+	}
+
+	err = ioutil.WriteFile(file, []byte(EncodePublicKey(public)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadIdentityFile(file)
+	if err != E_INVALID_KEY {
+		t.Errorf("ReadIdentityFile of a public key returned %v", err)
+	}
+}
+
+func TestArgon2Validate(t *testing.T) {
+	for _, test := range []struct {
+		stretching Argon2
+		valid      bool
+	}{
+		{DefaultArgon2, true},
+		{testArgon2, true},
+		{Argon2{Time: ARGON2_MAX_TIME, Memory: ARGON2_MAX_MEMORY, Threads: 255}, true},
+		{Argon2{}, false},
+		{Argon2{Time: 0, Memory: 64, Threads: 1}, false},
+		{Argon2{Time: 1, Memory: 64, Threads: 0}, false},
+		{Argon2{Time: 1, Memory: 8*4 - 1, Threads: 4}, false},
+		{Argon2{Time: ARGON2_MAX_TIME + 1, Memory: 64, Threads: 1}, false},
+		{Argon2{Time: 1, Memory: ARGON2_MAX_MEMORY + 1, Threads: 1}, false},
+		{Argon2{Time: 1, Memory: 1<<32 - 1, Threads: 1}, false},
+	} {
+		err := test.stretching.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("Validate of %+v returned %v", test.stretching, err)
+		}
+	}
+}
+
+// The parameters of a slot come from the backend, so a modified slot must not make the
+// restore stretch with them.
+func TestOversizedSlotParameters(t *testing.T) {
+	keys := &Keys{Passphrase: "passphrase", Argon2: testArgon2}
+	dataKey, slots, err := keys.NewSnapshotKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *slots[0].Argon2 != testArgon2 {
+		t.Fatalf("slot was stretched with %+v", slots[0].Argon2)
+	}
+
+	unlocked, err := keys.Unlock(&Metadata{KeySlots: slots})
+	if err != nil || !bytes.Equal(unlocked, dataKey) {
+		t.Fatalf("Unlock returned %x, %v", unlocked, err)
+	}
+
+	slots[0].Argon2 = &Argon2{Time: 1, Memory: 1<<32 - 1, Threads: 1}
+	_, err = unwrapPassphrase(keys.Passphrase, &slots[0])
+	if err != E_INVALID_KDF {
+		t.Errorf("unwrapping with oversized parameters returned %v", err)
+	}
+	_, err = keys.Unlock(&Metadata{KeySlots: slots})
+	if err != E_NO_KEY_SLOTS {
+		t.Errorf("Unlock with oversized parameters returned %v", err)
+	}
+
+	// Dropping the stretching of a slot does not open it with the bare passphrase
+	slots[0].Argon2 = nil
+	_, err = keys.Unlock(&Metadata{KeySlots: slots})
+	if err != E_NO_KEY_SLOTS {
+		t.Errorf("Unlock without the stretching of the slot returned %v", err)
+	}
+}
+
+func TestKeyCheck(t *testing.T) {
+	master := []byte("master")
+	iv := make([]byte, 32)
+	check := KeyCheck(master, iv)
+	if len(check) != 64 {
+		t.Fatalf("KeyCheck returned %q", check)
+	}
+	if KeyCheck([]byte("master"), make([]byte, 32)) != check {
+		t.Errorf("KeyCheck differs for the same key")
+	}
+
+	otherIV := make([]byte, 32)
+	otherIV[0] = 1
+	if KeyCheck([]byte("other"), iv) == check || KeyCheck(master, otherIV) == check {
+		t.Errorf("KeyCheck matches for another key or IV")
+	}
+	// It must not give away the keys derived from the same master key
+	authenticationKey, encryptionKey := DeriveKeys(master, iv)
+	if check == hex.EncodeToString(authenticationKey) || check == hex.EncodeToString(encryptionKey) {
+		t.Errorf("KeyCheck equals a derived key")
+	}
+}
+
+func TestParametersCheck(t *testing.T) {
+	meta := &Metadata{Uuid: "u1", IV: hex.EncodeToString(make([]byte, 32)), Format: FORMAT_SEALED, Encryption: "aes-gcm", Authentication: "hmac-sha3-512", ChunkSize: 1024}
+	check := ParametersCheck([]byte("master"), meta)
+	if ParametersCheck([]byte("master"), meta) != check {
+		t.Errorf("ParametersCheck differs for the same metadata")
+	}
+	if ParametersCheck([]byte("other"), meta) == check {
+		t.Errorf("ParametersCheck matches for another key")
+	}
+
+	for name, change := range map[string]func(meta *Metadata){
+		"uuid":           func(meta *Metadata) { meta.Uuid = "u2" },
+		"format":         func(meta *Metadata) { meta.Format = FORMAT_STREAM },
+		"encryption":     func(meta *Metadata) { meta.Encryption = "none" },
+		"authentication": func(meta *Metadata) { meta.Authentication = "none" },
+		"chunk size":     func(meta *Metadata) { meta.ChunkSize = 2048 },
+	} {
+		changed := *meta
+		change(&changed)
+		if ParametersCheck([]byte("master"), &changed) == check {
+			t.Errorf("ParametersCheck matches with another %s", name)
+		}
+	}
+	// Key slots and the key check are changed without the parameters
+	changed := *meta
+	changed.KeySlots = []KeySlot{{Type: KEY_SLOT_PASSPHRASE}}
+	changed.KeyCheck = "check"
+	if ParametersCheck([]byte("master"), &changed) != check {
+		t.Errorf("ParametersCheck depends on the key slots")
+	}
+}
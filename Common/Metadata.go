@@ -0,0 +1,63 @@
+package Common
+
+type MetadataBase struct {
+	Uuid           string
+	FileName       string
+	Encryption     string
+	Authentication string
+	IsData         bool
+}
+
+type Metadata struct {
+	Uuid           string
+	FileName       string
+	Encryption     string
+	Authentication string
+	HMAC           string
+	IV             string
+	TotalSizeIn    uint64
+	TotalSize      uint64
+	Chunks         uint
+	FileType       string
+	Subvolume      string
+	Date           int64
+	Parent         string
+	// FORMAT_STREAM for snapshots uploaded before it was stored
+	Format uint `json:",omitempty"`
+	// Bytes per chunk, except for the last one. Only stored for FORMAT_SEALED.
+	ChunkSize uint64 `json:",omitempty"`
+	// The data key of the snapshot, wrapped for each recipient. Empty if the keys are derived
+	// from the passphrase.
+	KeySlots []KeySlot `json:",omitempty"`
+	// KeyCheck of the master key, to detect a wrong passphrase or key. Not stored by older versions
+	KeyCheck string `json:",omitempty"`
+	// ParametersCheck of the fields above that tell how to download the snapshot. Stored with
+	// the key slots, so snapshots that have slots must have it.
+	ParametersCheck string `json:",omitempty"`
+	// All of the above, encrypted. Only set when the metadata is hidden from the backend.
+	Sealed string `json:",omitempty"`
+}
+
+type ChunkInfo struct {
+	Uuid           string
+	FileName       string
+	Encryption     string
+	Authentication string
+	IsData         bool
+	Chunk          uint
+}
+
+// RemoteChunk describes a chunk as stored on a backend.
+// Id is backend specific and only meaningful to the backend that returned it.
+type RemoteChunk struct {
+	Id    string
+	Chunk uint
+	MD5   string
+	Size  int64
+}
+
+type Quota struct {
+	Limit     uint64
+	Used      uint64
+	Unlimited bool
+}
@@ -0,0 +1,86 @@
+package Common
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Every backend names and tags its files the same way, so a folder can be
+// copied between backends without any translation.
+
+func ChunkFileName(uuid string, chunk uint) string {
+	return fmt.Sprintf("%s|%d", uuid, chunk)
+}
+
+func MetadataFileName(uuid string) string {
+	return fmt.Sprintf("%s|M", uuid)
+}
+
+func LatestFileName(subvolume string) string {
+	return fmt.Sprintf("%s|latest", subvolume)
+}
+
+func ChunkProperties(meta *ChunkInfo) map[string]string {
+	properties := make(map[string]string)
+	properties["OZB"] = "true"
+	properties["OZB_uuid"] = meta.Uuid
+	properties["OZB_chunk"] = fmt.Sprintf("%d", meta.Chunk)
+	properties["OZB_type"] = "data"
+	return properties
+}
+
+func MetadataProperties(meta *Metadata) map[string]string {
+	properties := make(map[string]string)
+	properties["OZB"] = "true"
+	properties["OZB_uuid"] = meta.Uuid
+	properties["OZB_filename"] = meta.FileName
+	properties["OZB_encryption"] = meta.Encryption
+	properties["OZB_authentication"] = meta.Authentication
+	properties["OZB_chunk"] = fmt.Sprintf("%d", meta.Chunks)
+	properties["OZB_storesize"] = fmt.Sprintf("%d", meta.TotalSize)
+	properties["OZB_size"] = fmt.Sprintf("%d", meta.TotalSizeIn)
+	properties["OZB_filetype"] = meta.FileType
+	properties["OZB_subvolume"] = meta.Subvolume
+	properties["OZB_parent"] = meta.Parent
+	properties["OZB_date"] = fmt.Sprintf("%d", meta.Date)
+	properties["OZB_type"] = "metadata"
+	return properties
+}
+
+func LatestProperties(latest *Snapshot, subvolume string) map[string]string {
+	properties := make(map[string]string)
+	properties["OZB"] = "true"
+	properties["OZB_uuid"] = latest.Uuid
+	properties["OZB_filename"] = latest.Filename
+	properties["OZB_chunk"] = "0"
+	properties["OZB_storesize"] = fmt.Sprintf("%d", len(latest.Filename))
+	properties["OZB_filetype"] = "latest"
+	properties["OZB_subvolume"] = subvolume
+	properties["OZB_date"] = fmt.Sprintf("%d", time.Now().Unix())
+	properties["OZB_type"] = "latest"
+	return properties
+}
+
+// MetadataFromProperties restores the indexed fields of a Metadata from the
+// properties written by MetadataProperties.
+func MetadataFromProperties(properties map[string]string) *Metadata {
+	chunks, _ := strconv.ParseUint(properties["OZB_chunk"], 10, 32)
+	size, _ := strconv.ParseUint(properties["OZB_storesize"], 10, 64)
+	sizeIn, _ := strconv.ParseUint(properties["OZB_size"], 10, 64)
+	date, _ := strconv.ParseInt(properties["OZB_date"], 10, 64)
+
+	return &Metadata{
+		Uuid:           properties["OZB_uuid"],
+		FileName:       properties["OZB_filename"],
+		Encryption:     properties["OZB_encryption"],
+		Authentication: properties["OZB_authentication"],
+		Chunks:         uint(chunks),
+		TotalSizeIn:    sizeIn,
+		TotalSize:      size,
+		FileType:       properties["OZB_filetype"],
+		Subvolume:      properties["OZB_subvolume"],
+		Date:           date,
+		Parent:         properties["OZB_parent"],
+	}
+}
@@ -0,0 +1,125 @@
+package Common
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// ErrorClass is what a backend knows about an error it returned.
+type ErrorClass struct {
+	// Retrying will not help, e.g. missing permissions, a missing file or a full quota
+	Permanent bool
+	// Minimum time to wait before the next attempt, e.g. when rate limited
+	Wait time.Duration
+}
+
+type permanentError struct {
+	error
+}
+
+// Permanent marks err as not worth retrying.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// ErrorClassifier is implemented by backends that can tell apart errors worth retrying.
+type ErrorClassifier interface {
+	// ClassifyError returns nil for errors the backend does not know.
+	ClassifyError(err error) *ErrorClass
+}
+
+// ClassifyError asks every backend that implements ErrorClassifier about err.
+// Errors none of them knows are considered transient.
+func ClassifyError(err error, backends ...Backend) *ErrorClass {
+	if _, ok := err.(permanentError); ok {
+		return &ErrorClass{Permanent: true}
+	}
+	switch err {
+	case E_NO_LATEST, E_NO_METADATA, E_NO_STREAMING, E_APPEND_ONLY:
+		return &ErrorClass{Permanent: true}
+	}
+
+	for _, backend := range backends {
+		classifier, ok := backend.(ErrorClassifier)
+		if !ok {
+			continue
+		}
+		class := classifier.ClassifyError(err)
+		if class != nil {
+			return class
+		}
+	}
+
+	return &ErrorClass{}
+}
+
+// RetryPolicy retries with exponential backoff and jitter.
+type RetryPolicy struct {
+	// 0 retries until Deadline
+	Attempts int
+	// Time after the first attempt to give up at. 0 for no deadline.
+	Deadline time.Duration
+	Initial  time.Duration
+	Max      time.Duration
+}
+
+// DefaultRetry is used for every backend call that is retried. It is set from the command line.
+var DefaultRetry = &RetryPolicy{Attempts: 10, Initial: 5 * time.Second, Max: 5 * time.Minute}
+
+// WithAttempts returns a copy of the policy limited to attempts.
+func (this *RetryPolicy) WithAttempts(attempts int) *RetryPolicy {
+	limited := *this
+	if limited.Attempts == 0 || attempts < limited.Attempts {
+		limited.Attempts = attempts
+	}
+	return &limited
+}
+
+// Do runs fn until it succeeds, returns a permanent error or the policy gives up.
+// Errors are classified by backends.
+func (this *RetryPolicy) Do(what string, fn func() error, backends ...Backend) error {
+	start := time.Now()
+	backoff := this.Initial
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		// Marked by the caller, who knows why it failed
+		if permanent, ok := err.(permanentError); ok {
+			return permanent.error
+		}
+
+		class := ClassifyError(err, backends...)
+		if class.Permanent {
+			log.Errorf("%s failed: %s. Not retrying, as this will not go away by itself.", what, err.Error())
+			return err
+		}
+		if this.Attempts > 0 && attempt >= this.Attempts {
+			log.Errorf("%s failed: %s. Giving up after %d attempts.", what, err.Error(), attempt)
+			return err
+		}
+
+		// Half of the backoff is random, so parallel uploads do not retry in lockstep
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if class.Wait > wait {
+			wait = class.Wait
+		}
+		if this.Deadline > 0 && time.Since(start)+wait > this.Deadline {
+			log.Errorf("%s failed: %s. Giving up after %s.", what, err.Error(), this.Deadline)
+			return err
+		}
+
+		log.Warnf("%s failed (attempt %d): %s. Retrying in %s...", what, attempt, err.Error(), wait.Round(time.Second))
+		time.Sleep(wait)
+
+		backoff *= 2
+		if backoff > this.Max {
+			backoff = this.Max
+		}
+	}
+}
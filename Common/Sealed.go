@@ -0,0 +1,214 @@
+package Common
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Data formats of a snapshot, stored in its metadata.
+const (
+	// The whole stream is encrypted with a stream cipher. One HMAC over the plaintext is
+	// only checked after everything was restored.
+	FORMAT_STREAM = 0
+	// The stream is cut into blocks sealed with an AEAD. Every block is checked before it is
+	// passed on.
+	FORMAT_SEALED = 1
+)
+
+// Size of a sealed block including its tag. Chunk sizes are multiples of it, so no block
+// spans two chunks.
+const SEALED_BLOCK_SIZE = 1024 * 1024
+
+var (
+	E_UNKNOWN_FORMAT  = errors.New("snapshot was uploaded in a newer data format. Update to restore it")
+	E_BLOCK_REJECTED  = errors.New("sealed block was modified, reordered or belongs to another snapshot")
+	E_BLOCK_TRUNCATED = errors.New("sealed stream ends without its final block. Chunks are missing")
+	E_BAD_CHUNK_SIZE  = errors.New("chunk size of the sealed snapshot is not a multiple of the block size")
+)
+
+// IsAEAD tells whether encryption is written in FORMAT_SEALED.
+func IsAEAD(encryption string) bool {
+	return encryption == "aes-gcm" || encryption == "chacha20-poly1305"
+}
+
+// NewAEAD returns the AEAD for encryption with a 32 byte key.
+func NewAEAD(encryptionKey []byte, encryption string) (cipher.AEAD, error) {
+	checkKeyLength(encryptionKey)
+	switch encryption {
+	case "aes-gcm":
+		block, err := aes.NewCipher(encryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case "chacha20-poly1305":
+		return chacha20poly1305.New(encryptionKey)
+	default:
+		return nil, errors.New("unsupported encryption method")
+	}
+}
+
+// ValidSealedChunkSize tells whether chunks of chunkSize bytes hold whole sealed blocks.
+func ValidSealedChunkSize(chunkSize uint64) bool {
+	return chunkSize > 0 && chunkSize%SEALED_BLOCK_SIZE == 0
+}
+
+// blockSealing holds what sealer and opener share. The key is unique per snapshot, so the
+// block counter is used as nonce. The associated data binds every block to its snapshot,
+// chunk and position, and marks the last block of the stream.
+type blockSealing struct {
+	aead           cipher.AEAD
+	uuid           string
+	blocksPerChunk uint64
+	block          uint64
+}
+
+func (this *blockSealing) nonce() []byte {
+	nonce := make([]byte, this.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], this.block)
+	return nonce
+}
+
+func (this *blockSealing) additionalData(final bool) []byte {
+	data := make([]byte, 0, 64)
+	data = append(data, "OZB sealed v1\x00"...)
+	data = append(data, this.uuid...)
+	data = append(data, 0)
+
+	var position [17]byte
+	binary.BigEndian.PutUint64(position[0:8], this.block/this.blocksPerChunk)
+	binary.BigEndian.PutUint64(position[8:16], this.block%this.blocksPerChunk)
+	if final {
+		position[16] = 1
+	}
+	return append(data, position[:]...)
+}
+
+// Sealer seals everything written to it in blocks of SEALED_BLOCK_SIZE and writes them to
+// writer. Close seals the final block, which may be empty.
+type Sealer struct {
+	blockSealing
+	writer io.Writer
+	buffer []byte
+}
+
+// NewSealer seals the data of snapshot uuid, which is cut into chunks of chunkSize bytes.
+func NewSealer(aead cipher.AEAD, uuid string, chunkSize int, writer io.Writer) *Sealer {
+	return &Sealer{
+		blockSealing: blockSealing{aead: aead, uuid: uuid, blocksPerChunk: uint64(chunkSize / SEALED_BLOCK_SIZE)},
+		writer:       writer,
+		buffer:       make([]byte, 0, SEALED_BLOCK_SIZE),
+	}
+}
+
+func (this *Sealer) plainSize() int {
+	return SEALED_BLOCK_SIZE - this.aead.Overhead()
+}
+
+func (this *Sealer) seal(final bool) error {
+	sealed := this.aead.Seal(nil, this.nonce(), this.buffer, this.additionalData(final))
+	this.block++
+	this.buffer = this.buffer[:0]
+
+	_, err := this.writer.Write(sealed)
+	return err
+}
+
+func (this *Sealer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full block is only sealed once more data follows, as the last one is marked
+		if len(this.buffer) == this.plainSize() {
+			err := this.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n := this.plainSize() - len(this.buffer)
+		if n > len(p) {
+			n = len(p)
+		}
+		this.buffer = append(this.buffer, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (this *Sealer) Close() error {
+	return this.seal(true)
+}
+
+// Opener reads the blocks written by a Sealer and only returns data of blocks that were
+// verified. A stream that ends before the final block fails with E_BLOCK_TRUNCATED.
+type Opener struct {
+	blockSealing
+	reader *bufio.Reader
+	sealed []byte
+	opened []byte
+	done   bool
+}
+
+// NewOpener opens the data of snapshot uuid. The chunk size comes from metadata that is
+// not authenticated, so it has to be checked with ValidSealedChunkSize first.
+func NewOpener(aead cipher.AEAD, uuid string, chunkSize uint64, reader io.Reader) *Opener {
+	return &Opener{
+		blockSealing: blockSealing{aead: aead, uuid: uuid, blocksPerChunk: chunkSize / SEALED_BLOCK_SIZE},
+		reader:       bufio.NewReaderSize(reader, SEALED_BLOCK_SIZE),
+		sealed:       make([]byte, SEALED_BLOCK_SIZE),
+	}
+}
+
+func (this *Opener) open() error {
+	n, err := io.ReadFull(this.reader, this.sealed)
+	if err == io.EOF {
+		return E_BLOCK_TRUNCATED
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	// Only the last block of the stream is followed by nothing
+	_, err = this.reader.Peek(1)
+	final := err == io.EOF
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	opened, err := this.aead.Open(this.opened[:0], this.nonce(), this.sealed[:n], this.additionalData(final))
+	if err != nil {
+		// The stream may have been cut right after a block that is not the final one
+		_, notFinal := this.aead.Open(nil, this.nonce(), this.sealed[:n], this.additionalData(false))
+		if final && notFinal == nil {
+			return E_BLOCK_TRUNCATED
+		}
+		return E_BLOCK_REJECTED
+	}
+	this.block++
+	this.opened = opened
+	this.done = final
+	return nil
+}
+
+func (this *Opener) Read(p []byte) (int, error) {
+	for len(this.opened) == 0 {
+		if this.done {
+			return 0, io.EOF
+		}
+		err := this.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, this.opened)
+	this.opened = this.opened[n:]
+	return n, nil
+}
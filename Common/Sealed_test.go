@@ -0,0 +1,154 @@
+package Common
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+var sealedCiphers = []string{"aes-gcm", "chacha20-poly1305"}
+
+func testAEAD(t *testing.T, encryption string) cipher.AEAD {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := NewAEAD(key, encryption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func seal(t *testing.T, aead cipher.AEAD, uuid string, chunkSize int, data []byte) []byte {
+	var sealed bytes.Buffer
+	sealer := NewSealer(aead, uuid, chunkSize, &sealed)
+	_, err := sealer.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sealer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func open(aead cipher.AEAD, uuid string, chunkSize int, sealed []byte) ([]byte, error) {
+	return ioutil.ReadAll(NewOpener(aead, uuid, uint64(chunkSize), bytes.NewReader(sealed)))
+}
+
+func TestSealedRoundTrip(t *testing.T) {
+	for _, encryption := range sealedCiphers {
+		aead := testAEAD(t, encryption)
+		plain := SEALED_BLOCK_SIZE - aead.Overhead()
+
+		for _, size := range []int{0, 1, plain, plain + 1, 5*plain + 17} {
+			data := make([]byte, size)
+			rand.Read(data)
+
+			sealed := seal(t, aead, "u1", 2*SEALED_BLOCK_SIZE, data)
+			opened, err := open(aead, "u1", 2*SEALED_BLOCK_SIZE, sealed)
+			if err != nil {
+				t.Errorf("%s: opening %d bytes returned %v", encryption, size, err)
+				continue
+			}
+			if !bytes.Equal(opened, data) {
+				t.Errorf("%s: %d bytes differ after opening", encryption, size)
+			}
+		}
+	}
+}
+
+func TestSealedTampering(t *testing.T) {
+	for _, encryption := range sealedCiphers {
+		aead := testAEAD(t, encryption)
+		data := make([]byte, 3*SEALED_BLOCK_SIZE)
+		rand.Read(data)
+		sealed := seal(t, aead, "u1", SEALED_BLOCK_SIZE, data)
+		if len(sealed)/SEALED_BLOCK_SIZE+1 != 4 {
+			t.Fatalf("sealed into %d bytes, want 4 blocks", len(sealed))
+		}
+
+		block := func(i int) []byte {
+			end := (i + 1) * SEALED_BLOCK_SIZE
+			if end > len(sealed) {
+				end = len(sealed)
+			}
+			return sealed[i*SEALED_BLOCK_SIZE : end]
+		}
+		join := func(indices ...int) []byte {
+			var joined []byte
+			for _, i := range indices {
+				joined = append(joined, block(i)...)
+			}
+			return joined
+		}
+
+		flipped := append([]byte{}, sealed...)
+		flipped[SEALED_BLOCK_SIZE+100] ^= 1
+
+		for _, test := range []struct {
+			name      string
+			uuid      string
+			chunkSize int
+			sealed    []byte
+			err       error
+		}{
+			{"flipped bit", "u1", SEALED_BLOCK_SIZE, flipped, E_BLOCK_REJECTED},
+			{"swapped blocks", "u1", SEALED_BLOCK_SIZE, join(1, 0, 2, 3), E_BLOCK_REJECTED},
+			{"repeated block", "u1", SEALED_BLOCK_SIZE, join(0, 0, 1, 2, 3), E_BLOCK_REJECTED},
+			{"missing final block", "u1", SEALED_BLOCK_SIZE, join(0, 1, 2), E_BLOCK_TRUNCATED},
+			{"truncated final block", "u1", SEALED_BLOCK_SIZE, sealed[:len(sealed)-1], E_BLOCK_REJECTED},
+			{"nothing", "u1", SEALED_BLOCK_SIZE, nil, E_BLOCK_TRUNCATED},
+			{"other snapshot", "u2", SEALED_BLOCK_SIZE, sealed, E_BLOCK_REJECTED},
+			{"other chunk size", "u1", 2 * SEALED_BLOCK_SIZE, sealed, E_BLOCK_REJECTED},
+		} {
+			_, err := open(aead, test.uuid, test.chunkSize, test.sealed)
+			if err != test.err {
+				t.Errorf("%s: opening with %s returned %v, want %v", encryption, test.name, err, test.err)
+			}
+		}
+
+		_, err := open(testAEAD(t, encryption), "u1", SEALED_BLOCK_SIZE, sealed)
+		if err != E_BLOCK_REJECTED {
+			t.Errorf("%s: opening with another key returned %v", encryption, err)
+		}
+	}
+}
+
+// Blocks of a chunk of another snapshot sealed with the same key are rejected, even at
+// the same position.
+func TestSealedChunkOfOtherSnapshot(t *testing.T) {
+	aead := testAEAD(t, "aes-gcm")
+	data := make([]byte, 2*SEALED_BLOCK_SIZE)
+	rand.Read(data)
+
+	first := seal(t, aead, "u1", SEALED_BLOCK_SIZE, data)
+	second := seal(t, aead, "u2", SEALED_BLOCK_SIZE, data)
+	mixed := append(append([]byte{}, first[:SEALED_BLOCK_SIZE]...), second[SEALED_BLOCK_SIZE:]...)
+
+	_, err := open(aead, "u1", SEALED_BLOCK_SIZE, mixed)
+	if err != E_BLOCK_REJECTED {
+		t.Errorf("opening a chunk of another snapshot returned %v", err)
+	}
+}
+
+func TestValidSealedChunkSize(t *testing.T) {
+	for size, valid := range map[uint64]bool{
+		0:                         false,
+		1:                         false,
+		SEALED_BLOCK_SIZE - 1:     false,
+		SEALED_BLOCK_SIZE:         true,
+		SEALED_BLOCK_SIZE + 1:     false,
+		40 * SEALED_BLOCK_SIZE:    true,
+		40*SEALED_BLOCK_SIZE + 16: false,
+	} {
+		if ValidSealedChunkSize(size) != valid {
+			t.Errorf("ValidSealedChunkSize(%d) = %v", size, !valid)
+		}
+	}
+}
@@ -25,6 +25,9 @@ type SnapshotManager interface {
 	ListLocalSnapshots() []string
 	DeleteSnapshot(snapshot string) (bool, error)
 	Stream(snapshot string, parentSnapshot string) (io.ReadCloser, error)
+	// EstimateSize estimates the bytes Stream would send for a snapshot of subvolume taken now,
+	// without taking it.
+	EstimateSize(subvolume string, parentSnapshot string) (uint64, error)
 	Restore(targetSubvolume string) (io.WriteCloser, error)
 }
 
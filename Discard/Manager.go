@@ -45,6 +45,10 @@ func (this *Manager) Stream(snapshot string, parentSnapshot string) (io.ReadClos
 	return nil, E_STUB
 }
 
+func (this *Manager) EstimateSize(subvolume string, parentSnapshot string) (uint64, error) {
+	return 0, E_STUB
+}
+
 func (this *Manager) Restore(_ string) (io.WriteCloser, error) {
 	log.Warn("---- Discarding downloaded data ----")
 	return DiscardCloser{}, nil
@@ -0,0 +1,173 @@
+package GoogleDrive
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+)
+
+const SERVICE_ACCOUNT_SECRET = "serviceaccount.json"
+
+// getServiceAccount returns the service account key in file or in Vault, or nil if there is none.
+func getServiceAccount(file string) ([]byte, error) {
+	if file != "" {
+		return ioutil.ReadFile(file)
+	}
+	if key := secretsCache[SERVICE_ACCOUNT_SECRET]; key != "" {
+		return []byte(key), nil
+	}
+	return nil, nil
+}
+
+// serviceAccountClient authenticates as a service account. With domain-wide delegation
+// it acts as the user subject, otherwise as itself.
+func serviceAccountClient(ctx context.Context, key []byte, subject string, scope string) (*http.Client, error) {
+	config, err := google.JWTConfigFromJSON(key, scope)
+	if err != nil {
+		return nil, err
+	}
+	config.Subject = subject
+
+	log.Infof("Authenticating as service account %s...", config.Email)
+	return config.Client(ctx), nil
+}
+
+// UseAdminServiceAccount switches all following calls to the service account in keyFile,
+// acting as subject if it is not empty. Backups are made with credentials that cannot
+// delete, so cleanups use this one. It needs the full drive scope to see the files
+// created by the other credentials.
+func UseAdminServiceAccount(keyFile string, subject string) error {
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	client, err := serviceAccountClient(context.Background(), key, subject, drive.DriveScope)
+	if err != nil {
+		return err
+	}
+	service, err := drive.New(client)
+	if err != nil {
+		return err
+	}
+
+	httpClient = client
+	srv = service
+	return nil
+}
+
+// getTokenFromWeb lets the user authorize us in a browser and receives the
+// authorization code on a local HTTP server (loopback redirect).
+// It returns the retrieved Token.
+func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("Unable to listen for the authorization code %v", err)
+	}
+	config.RedirectURL = "http://" + listener.Addr().String() + "/"
+
+	random := make([]byte, 16)
+	_, err = rand.Read(random)
+	if err != nil {
+		log.Fatalf("Unable to generate state %v", err)
+	}
+	state := fmt.Sprintf("%x", random)
+
+	codes := make(chan string, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("state") != state {
+			http.Error(w, "Invalid state", http.StatusBadRequest)
+			return
+		}
+		if query.Get("code") == "" {
+			http.Error(w, "Authorization failed: "+query.Get("error"), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "Authorization successful. You can close this window.")
+		select {
+		case codes <- query.Get("code"):
+		default:
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+	fmt.Fprintf(os.Stderr, "Go to the following link in your browser: \n%v\n"+
+		"On a remote machine forward the port first: ssh -L %d:%s <host>\n",
+		authURL, listener.Addr().(*net.TCPAddr).Port, listener.Addr().String())
+
+	code := <-codes
+
+	tok, err := config.Exchange(context.Background(), code)
+	if err != nil {
+		log.Fatalf("Unable to retrieve token from web %v", err)
+	}
+
+	return tok
+}
+
+// persistingTokenSource writes every refreshed token back, so the refresh token
+// and the latest access token survive a restart.
+type persistingTokenSource struct {
+	source  oauth2.TokenSource
+	lock    sync.Mutex
+	last    *oauth2.Token
+	persist func(*oauth2.Token) error
+}
+
+func (this *persistingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := this.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.last != nil && this.last.AccessToken == token.AccessToken {
+		return token, nil
+	}
+	this.last = token
+
+	log.Infoln("Saving refreshed token...")
+	err = this.persist(token)
+	if err != nil {
+		// The token still works, it just has to be refreshed again next time
+		log.Errorf("Unable to save refreshed token: %v", err)
+	}
+
+	return token, nil
+}
+
+// vaultPersister writes a token back into the secret the other secrets were read from.
+func vaultPersister(client *vault.Client, secrets map[string]string) func(*oauth2.Token) error {
+	data := make(map[string]interface{}, len(secrets))
+	for k, v := range secrets {
+		data[k] = v
+	}
+
+	return func(token *oauth2.Token) error {
+		marshalled, err := json.Marshal(token)
+		if err != nil {
+			return err
+		}
+		data["offsite-zfs-backup.json"] = string(marshalled)
+
+		_, err = client.Logical().Write("/secret/ozb/googledrive", data)
+		return err
+	}
+}
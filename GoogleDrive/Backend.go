@@ -0,0 +1,196 @@
+package GoogleDrive
+
+import (
+	"io"
+	"strconv"
+
+	"../Common"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+)
+
+// Backend stores snapshots in one Google Drive folder.
+// InitGoogleDrive has to be called before it is used.
+type Backend struct {
+	folderId string
+}
+
+func NewBackend(folder string) *Backend {
+	this := &Backend{}
+	if folder != "" {
+		this.folderId = FindOrCreateFolder(folder)
+	}
+	return this
+}
+
+func (this *Backend) PutChunk(info *Common.ChunkInfo, reader io.Reader, wantedMD5 string) error {
+	_, err := Upload(info, this.folderId, reader, wantedMD5)
+	return err
+}
+
+// StreamChunk uploads the chunk as it is read. An interrupted stream cannot be resumed.
+func (this *Backend) StreamChunk(info *Common.ChunkInfo, reader io.Reader) (string, error) {
+	file, err := Upload(info, this.folderId, reader, "")
+	if err != nil {
+		return "", err
+	}
+	return waitForMD5(file)
+}
+
+// ListChunks only returns the newest file of every chunk. Drive allows several files with
+// the same name, so a chunk that was uploaded again, e.g. after its MD5 did not match, sits
+// next to the earlier copies. They are only deleted with their snapshot, as backups may
+// not be allowed to delete.
+func (this *Backend) ListChunks(uuid string) ([]*Common.RemoteChunk, error) {
+	var files []*drive.File
+
+	err := filesList().
+		Fields("nextPageToken, files(id, size, md5Checksum, createdTime, properties)").
+		Q("'"+this.folderId+"' in parents AND trashed = false AND properties has { key='OZB_uuid' and value='"+uuid+"' } AND properties has { key='OZB_type' and value='data' }").
+		Pages(context.Background(), func(fileList *drive.FileList) error {
+			files = append(files, fileList.Files...)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return newestChunks(files)
+}
+
+// newestChunks returns the chunks of files, taking the newest file of chunks that were
+// uploaded more than once.
+func newestChunks(files []*drive.File) ([]*Common.RemoteChunk, error) {
+	newest := make(map[uint]*drive.File)
+	var order []uint
+	for _, file := range files {
+		raw, err := strconv.ParseUint(file.Properties["OZB_chunk"], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		chunk := uint(raw)
+
+		current, seen := newest[chunk]
+		if !seen {
+			order = append(order, chunk)
+		}
+		// createdTime is RFC 3339 in UTC, so it sorts as a string
+		if !seen || file.CreatedTime > current.CreatedTime {
+			newest[chunk] = file
+		}
+	}
+
+	chunks := make([]*Common.RemoteChunk, 0, len(order))
+	for _, chunk := range order {
+		file := newest[chunk]
+		chunks = append(chunks, &Common.RemoteChunk{Id: file.Id, Chunk: chunk, MD5: file.Md5Checksum, Size: file.Size})
+	}
+	return chunks, nil
+}
+
+func (this *Backend) GetChunk(chunk *Common.RemoteChunk, writer io.Writer) (int64, error) {
+	return Download(chunk.Id, writer)
+}
+
+func (this *Backend) PutMetadata(meta *Common.Metadata) error {
+	return UploadMetadata(meta, this.folderId)
+}
+
+func (this *Backend) GetMetadata(uuid string) (*Common.Metadata, error) {
+	return FetchMetadata(uuid, this.folderId)
+}
+
+func (this *Backend) ListMetadata(fileType string, subvolume string, callback func(*Common.Metadata)) error {
+	_, err := FindInFolder(this.folderId, fileType, subvolume, func(file *drive.File) {
+		callback(Common.MetadataFromProperties(file.Properties))
+	})
+	return err
+}
+
+func (this *Backend) GetLatest(subvolume string) (*Common.Snapshot, error) {
+	file, err := FindLatest(this.folderId, subvolume)
+	if err != nil || file == nil {
+		return nil, err
+	}
+
+	return &Common.Snapshot{Uuid: file.Properties["OZB_uuid"], Filename: file.Properties["OZB_filename"]}, nil
+}
+
+func (this *Backend) SetLatest(subvolume string, latest *Common.Snapshot) error {
+	_, err := SaveLatest(latest.Filename, latest.Uuid, subvolume, this.folderId)
+	return err
+}
+
+func (this *Backend) ListUuids() ([]string, error) {
+	seen := make(map[string]bool)
+	var uuids []string
+
+	err := filesList().
+		Fields("nextPageToken, files(properties)").
+		Q("'"+this.folderId+"' in parents AND trashed = false").
+		Pages(context.Background(), func(fileList *drive.FileList) error {
+			for _, file := range fileList.Files {
+				uuid := file.Properties["OZB_uuid"]
+				if uuid == "" || seen[uuid] {
+					continue
+				}
+				seen[uuid] = true
+				uuids = append(uuids, uuid)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return uuids, nil
+}
+
+func (this *Backend) Delete(uuid string) error {
+	var ids []string
+
+	err := filesList().
+		Fields("nextPageToken, files(id)").
+		Q("'"+this.folderId+"' in parents AND trashed = false AND properties has { key='OZB_uuid' and value='"+uuid+"' }").
+		Pages(context.Background(), func(fileList *drive.FileList) error {
+			for _, file := range fileList.Files {
+				ids = append(ids, file.Id)
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err = deleteFile(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *Backend) Quota() (*Common.Quota, error) {
+	if sharedDrive == "" {
+		return getQuota()
+	}
+
+	// Shared Drives do not have a quota of their own, so report what the folder uses
+	quota := &Common.Quota{Unlimited: true}
+	err := filesList().
+		Fields("nextPageToken, files(size)").
+		Q("'"+this.folderId+"' in parents AND trashed = false").
+		Pages(context.Background(), func(fileList *drive.FileList) error {
+			for _, file := range fileList.Files {
+				quota.Used += uint64(file.Size)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return quota, nil
+}
@@ -0,0 +1,37 @@
+package GoogleDrive
+
+import (
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+)
+
+func TestNewestChunks(t *testing.T) {
+	chunk := func(id string, chunk string, created string) *drive.File {
+		return &drive.File{Id: id, CreatedTime: created, Md5Checksum: id, Properties: map[string]string{"OZB_chunk": chunk}}
+	}
+
+	chunks, err := newestChunks([]*drive.File{
+		chunk("retried", "0", "2026-10-17T10:00:05.000Z"),
+		chunk("mismatched", "0", "2026-10-17T10:00:00.000Z"),
+		chunk("single", "1", "2026-10-17T10:00:01.000Z"),
+		chunk("migrated", "2", "2026-10-18T08:00:00.000Z"),
+		chunk("damaged", "2", "2026-10-17T10:00:02.000Z"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("newestChunks returned %d chunks", len(chunks))
+	}
+	for i, id := range []string{"retried", "single", "migrated"} {
+		if chunks[i].Chunk != uint(i) || chunks[i].Id != id || chunks[i].MD5 != id {
+			t.Errorf("chunk %d is %+v, want %s", i, chunks[i], id)
+		}
+	}
+
+	_, err = newestChunks([]*drive.File{chunk("broken", "x", "")})
+	if err == nil {
+		t.Errorf("newestChunks accepted a chunk without a number")
+	}
+}
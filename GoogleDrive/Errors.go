@@ -0,0 +1,74 @@
+package GoogleDrive
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"../Common"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Reasons of a 403 that go away by waiting
+var rateLimitReasons = map[string]bool{
+	"rateLimitExceeded":        true,
+	"userRateLimitExceeded":    true,
+	"sharingRateLimitExceeded": true,
+}
+
+// retryAfter returns how long Drive asked us to wait, if it did.
+func retryAfter(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func isRateLimited(apiErr *googleapi.Error) bool {
+	if apiErr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	if apiErr.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range apiErr.Errors {
+		if rateLimitReasons[item.Reason] {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Backend) ClassifyError(err error) *Common.ErrorClass {
+	if err == E_SESSION_EXPIRED {
+		// The next attempt starts a new session
+		return &Common.ErrorClass{}
+	}
+
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		// The refresh token was revoked or the client secret is wrong
+		if retrieveErr.Response != nil && retrieveErr.Response.StatusCode < 500 {
+			return &Common.ErrorClass{Permanent: true}
+		}
+		return nil
+	}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return nil
+	}
+
+	switch {
+	case isRateLimited(apiErr):
+		return &Common.ErrorClass{Wait: retryAfter(apiErr.Header)}
+	case apiErr.Code >= 500 || apiErr.Code == http.StatusRequestTimeout:
+		return &Common.ErrorClass{}
+	default:
+		// Authentication, permissions, missing files and a full storage quota
+		return &Common.ErrorClass{Permanent: true}
+	}
+}
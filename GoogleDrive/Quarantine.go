@@ -0,0 +1,154 @@
+package GoogleDrive
+
+import (
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+)
+
+// Quarantined files are moved into this folder inside the backup folder, with the time
+// they were moved as property. Drive's trash is not used, as it is emptied after 30 days.
+const QUARANTINE_FOLDER = "quarantine"
+
+const FOLDER_MIME_TYPE = "application/vnd.google-apps.folder"
+
+// quarantineFolder returns the id of the quarantine folder, which is created on first use.
+func (this *Backend) quarantineFolder() (string, error) {
+	id, err := findFileIdInParentId(QUARANTINE_FOLDER, this.folderId)
+	if err != E_NOPARENT {
+		return id, err
+	}
+
+	f := drive.File{Name: QUARANTINE_FOLDER, MimeType: FOLDER_MIME_TYPE, Parents: []string{this.folderId}}
+	res, err := srv.Files.Create(&f).SupportsAllDrives(true).Fields("id").Do()
+	if err != nil {
+		return "", err
+	}
+	return res.Id, nil
+}
+
+// filesOf returns the files of the snapshot uuid in folder.
+func filesOf(uuid string, folder string) ([]*drive.File, error) {
+	var files []*drive.File
+
+	err := filesList().
+		Fields("nextPageToken, files(id, name, properties)").
+		Q("'"+folder+"' in parents AND trashed = false AND properties has { key='OZB_uuid' and value='"+uuid+"' }").
+		Pages(context.Background(), func(fileList *drive.FileList) error {
+			files = append(files, fileList.Files...)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// move moves the files of uuid from one folder to another and applies update to them.
+// Files that already exist in the other folder are kept there.
+func move(uuid string, from string, to string, update *drive.File) error {
+	files, err := filesOf(uuid, from)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		_, err = findFileIdInParentId(file.Name, to)
+		if err == nil {
+			err = deleteFile(file.Id)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != E_NOPARENT {
+			return err
+		}
+
+		_, err = srv.Files.Update(file.Id, update).
+			AddParents(to).
+			RemoveParents(from).
+			SupportsAllDrives(true).
+			Do()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *Backend) Quarantine(uuid string) error {
+	quarantine, err := this.quarantineFolder()
+	if err != nil {
+		return err
+	}
+
+	update := &drive.File{Properties: map[string]string{"OZB_quarantined": strconv.FormatInt(time.Now().Unix(), 10)}}
+	return move(uuid, this.folderId, quarantine, update)
+}
+
+func (this *Backend) ListQuarantined() (map[string]time.Time, error) {
+	quarantine, err := this.quarantineFolder()
+	if err != nil {
+		return nil, err
+	}
+
+	quarantined := make(map[string]time.Time)
+	err = filesList().
+		Fields("nextPageToken, files(properties)").
+		Q("'"+quarantine+"' in parents AND trashed = false").
+		Pages(context.Background(), func(fileList *drive.FileList) error {
+			for _, file := range fileList.Files {
+				uuid := file.Properties["OZB_uuid"]
+				if uuid == "" {
+					continue
+				}
+				since, _ := strconv.ParseInt(file.Properties["OZB_quarantined"], 10, 64)
+				// The last file moved counts
+				if at := time.Unix(since, 0); at.After(quarantined[uuid]) {
+					quarantined[uuid] = at
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return quarantined, nil
+}
+
+func (this *Backend) RestoreQuarantined(uuid string) error {
+	quarantine, err := this.quarantineFolder()
+	if err != nil {
+		return err
+	}
+
+	update := &drive.File{NullFields: []string{"Properties.OZB_quarantined"}}
+	return move(uuid, quarantine, this.folderId, update)
+}
+
+func (this *Backend) Purge(uuid string) error {
+	quarantine, err := this.quarantineFolder()
+	if err != nil {
+		return err
+	}
+
+	files, err := filesOf(uuid, quarantine)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		err = deleteFile(file.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,268 @@
+package GoogleDrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const UPLOAD_URL = "https://www.googleapis.com/upload/drive/v3/files?uploadType=resumable&supportsAllDrives=true&fields=id,md5Checksum"
+
+// Drive expires upload sessions after a week
+const SESSION_LIFETIME = 7 * 24 * time.Hour
+
+var E_SESSION_EXPIRED = errors.New("upload session expired")
+
+// The authenticated client of srv, for the requests the generated API does not offer.
+var httpClient *http.Client
+
+// uploadSession is persisted while a file is uploaded, so the upload can be resumed
+// after the connection dropped, even by another process.
+// The session URI is only used for the same content. Sessions are keyed by the chunk
+// file name, which contains the uuid of the snapshot. Only a restarted migration uploads
+// the same chunks again, a restarted backup starts a new snapshot.
+type uploadSession struct {
+	URI  string
+	MD5  string
+	Size int64
+}
+
+var rangeHeader = regexp.MustCompile(`^bytes=0-(\d+)$`)
+
+var pruneOnce sync.Once
+
+// sessionFile returns where the session for name is persisted.
+func sessionFile(name string) (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	sessionDir := filepath.Join(usr.HomeDir, ".credentials", "offsite-zfs-backup-uploads")
+	err = os.MkdirAll(sessionDir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	pruneOnce.Do(func() { pruneSessions(sessionDir) })
+	return filepath.Join(sessionDir, name+".json"), nil
+}
+
+// pruneSessions removes the sessions Drive has expired by now. They are left behind
+// by backups that were interrupted and never uploaded the same chunks again.
+func pruneSessions(sessionDir string) {
+	entries, err := ioutil.ReadDir(sessionDir)
+	if err != nil {
+		log.Warnf("Could not list upload sessions: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if time.Since(entry.ModTime()) > SESSION_LIFETIME {
+			os.Remove(filepath.Join(sessionDir, entry.Name()))
+		}
+	}
+}
+
+func loadSession(file string, md5 string, size int64) string {
+	marshalled, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+
+	session := &uploadSession{}
+	err = json.Unmarshal(marshalled, session)
+	if err != nil || session.MD5 != md5 || session.Size != size {
+		return ""
+	}
+
+	return session.URI
+}
+
+func saveSession(file string, session *uploadSession) error {
+	marshalled, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, marshalled, 0600)
+}
+
+// startSession initiates a resumable upload and returns the session URI.
+func startSession(file *drive.File, size int64) (string, error) {
+	body, err := json.Marshal(file)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", UPLOAD_URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	err = googleapi.CheckResponse(res)
+	if err != nil {
+		return "", err
+	}
+
+	return res.Header.Get("Location"), nil
+}
+
+// finishedOrOffset interprets the response to a request against a session.
+// It returns the file if the upload is complete, or the offset to continue at.
+func finishedOrOffset(res *http.Response) (*drive.File, int64, error) {
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		file := &drive.File{}
+		err := json.NewDecoder(res.Body).Decode(file)
+		return file, 0, err
+	case http.StatusPermanentRedirect:
+		// No Range header means nothing was received yet
+		match := rangeHeader.FindStringSubmatch(res.Header.Get("Range"))
+		if match == nil {
+			return nil, 0, nil
+		}
+		last, err := strconv.ParseInt(match[1], 10, 64)
+		return nil, last + 1, err
+	case http.StatusNotFound, http.StatusGone:
+		return nil, 0, E_SESSION_EXPIRED
+	default:
+		return nil, 0, googleapi.CheckResponse(res)
+	}
+}
+
+// sessionStatus asks how much of the upload arrived.
+func sessionStatus(uri string, size int64) (*drive.File, int64, error) {
+	req, err := http.NewRequest("PUT", uri, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	return finishedOrOffset(res)
+}
+
+// sendFrom uploads everything from offset to the end.
+func sendFrom(uri string, reader io.ReadSeeker, offset int64, size int64) (*drive.File, int64, error) {
+	_, err := reader.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequest("PUT", uri, ioutil.NopCloser(io.LimitReader(reader, size-offset)))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.ContentLength = size - offset
+	if size == 0 {
+		// There is no byte range of an empty file
+		req.Header.Set("Content-Range", "bytes */0")
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	return finishedOrOffset(res)
+}
+
+// resumableUpload creates file with the content of reader. An upload of the same
+// content that was interrupted before continues where it stopped.
+func resumableUpload(file *drive.File, reader io.ReadSeeker, md5 string) (*drive.File, error) {
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	persisted, err := sessionFile(file.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	uri := ""
+	if md5 != "" {
+		uri = loadSession(persisted, md5, size)
+	}
+	if uri != "" {
+		var done *drive.File
+		done, offset, err = sessionStatus(uri, size)
+		if err == E_SESSION_EXPIRED {
+			os.Remove(persisted)
+			uri = ""
+		} else if err != nil {
+			return nil, err
+		} else if done != nil {
+			os.Remove(persisted)
+			return done, nil
+		} else {
+			log.Infof("Resuming upload of %s at %d of %d bytes", file.Name, offset, size)
+		}
+	}
+	if uri == "" {
+		offset = 0
+		uri, err = startSession(file, size)
+		if err != nil {
+			return nil, err
+		}
+		if md5 != "" {
+			err = saveSession(persisted, &uploadSession{URI: uri, MD5: md5, Size: size})
+			if err != nil {
+				log.Errorf("Could not persist upload session: %v", err)
+			}
+		}
+	}
+
+	for {
+		done, next, err := sendFrom(uri, reader, offset, size)
+		if err == E_SESSION_EXPIRED {
+			os.Remove(persisted)
+			return nil, err
+		}
+		if err != nil {
+			// The session is kept for the next attempt
+			return nil, err
+		}
+		if done != nil {
+			os.Remove(persisted)
+			return done, nil
+		}
+		if next <= offset {
+			return nil, fmt.Errorf("upload of %s did not progress past %d bytes", file.Name, offset)
+		}
+		// Not everything was taken, send the rest
+		offset = next
+	}
+}
@@ -0,0 +1,128 @@
+package GoogleDrive
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestSession returns the URI of a fake upload session that takes at most accept bytes
+// per request and stores them in received.
+func newTestSession(t *testing.T, size int64, accept int64, received *bytes.Buffer) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var first, last, total int64
+		contentRange := r.Header.Get("Content-Range")
+		if size == 0 {
+			if contentRange != "bytes */0" {
+				t.Errorf("empty upload sent Content-Range %q", contentRange)
+			}
+		} else {
+			_, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &first, &last, &total)
+			if err != nil || first != int64(received.Len()) || last != size-1 || total != size {
+				t.Errorf("Content-Range %q after %d bytes", contentRange, received.Len())
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		if int64(len(body)) > accept {
+			body = body[:accept]
+		}
+		received.Write(body)
+
+		if int64(received.Len()) < size {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received.Len()-1))
+			w.WriteHeader(http.StatusPermanentRedirect)
+			return
+		}
+		fmt.Fprint(w, `{"id": "file"}`)
+	}))
+	t.Cleanup(server.Close)
+
+	previous := httpClient
+	httpClient = server.Client()
+	t.Cleanup(func() { httpClient = previous })
+
+	return server.URL + "/session"
+}
+
+func TestSendFrom(t *testing.T) {
+	data := []byte("0123456789")
+	var received bytes.Buffer
+	uri := newTestSession(t, int64(len(data)), 4, &received)
+
+	var offset int64
+	for attempt := 0; ; attempt++ {
+		done, next, err := sendFrom(uri, bytes.NewReader(data), offset, int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done != nil {
+			break
+		}
+		if attempt == 3 || next <= offset {
+			t.Fatalf("upload stuck at %d", next)
+		}
+		offset = next
+	}
+
+	if !bytes.Equal(received.Bytes(), data) {
+		t.Errorf("received %q", received.Bytes())
+	}
+}
+
+func TestSendFromEmpty(t *testing.T) {
+	var received bytes.Buffer
+	uri := newTestSession(t, 0, 0, &received)
+
+	done, _, err := sendFrom(uri, bytes.NewReader(nil), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done == nil || done.Id != "file" {
+		t.Errorf("empty upload returned %+v", done)
+	}
+}
+
+func TestPruneSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ozbsessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expired := filepath.Join(dir, "expired.json")
+	current := filepath.Join(dir, "current.json")
+	for _, file := range []string{expired, current} {
+		err = saveSession(file, &uploadSession{URI: "uri", MD5: "md5", Size: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-SESSION_LIFETIME - time.Hour)
+	err = os.Chtimes(expired, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pruneSessions(dir)
+
+	if _, err = os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("expired session was kept")
+	}
+	if loadSession(current, "md5", 1) != "uri" {
+		t.Errorf("current session was removed")
+	}
+}
@@ -0,0 +1,63 @@
+package GoogleDrive
+
+import (
+	"github.com/prometheus/common/log"
+	"google.golang.org/api/drive/v3"
+)
+
+// Id of the Shared Drive everything is stored in. Empty for My Drive.
+var sharedDrive string
+
+// SetSharedDrive makes all following calls use the Shared Drive with the given id or name
+// instead of My Drive.
+// InitGoogleDrive has to be called before.
+func SetSharedDrive(idOrName string) {
+	found, err := srv.Drives.Get(idOrName).Fields("id").Do()
+	if err == nil {
+		sharedDrive = found.Id
+		return
+	}
+
+	drives, listErr := srv.Drives.List().Q("name = '" + idOrName + "'").Fields("drives(id)").Do()
+	if listErr == nil && len(drives.Drives) != 0 {
+		sharedDrive = drives.Drives[0].Id
+		return
+	}
+
+	// Looking up drives needs more than the drive.file scope we ask for, so trust the id
+	log.Warnf("Could not look up shared drive '%s' (%v). Using it as id.", idOrName, err)
+	sharedDrive = idOrName
+}
+
+// rootId is the id of the folder our folders are created in.
+func rootId() string {
+	if sharedDrive != "" {
+		return sharedDrive
+	}
+	return "root"
+}
+
+// filesList lists files in My Drive or in the Shared Drive.
+// Pages are as large as Drive allows, as our folders hold thousands of chunks.
+func filesList() *drive.FilesListCall {
+	call := srv.Files.List().PageSize(1000)
+	if sharedDrive != "" {
+		call = call.
+			Corpora("drive").
+			DriveId(sharedDrive).
+			IncludeItemsFromAllDrives(true).
+			SupportsAllDrives(true)
+	}
+	return call
+}
+
+// deleteFile deletes a file from My Drive. Files in a Shared Drive are trashed,
+// as deleting them needs the manager role. The Shared Drive removes them after 30 days.
+func deleteFile(id string) error {
+	if sharedDrive == "" {
+		return srv.Files.Delete(id).Do()
+	}
+
+	_, err := srv.Files.Update(id, &drive.File{Trashed: true}).SupportsAllDrives(true).Do()
+	return err
+}
@@ -2,7 +2,6 @@ package GoogleDrive
 
 import (
 	"bytes"
-	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,168 +13,48 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"time"
 
 	"../Common"
-	"github.com/dustin/go-humanize"
 	vault "github.com/hashicorp/vault/api"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 )
 
 var (
-	E_NOPARENT              = errors.New("no parent found")
-	E_NO_LATEST             = errors.New("no latest found")
-	E_BACKEND_HASH_MISMATCH = errors.New("hash of remote file differs from local file")
+	E_NOPARENT = errors.New("no parent found")
 )
 
-type MetadataBase struct {
-	Uuid           string
-	FileName       string
-	Encryption     string
-	Authentication string
-	IsData         bool
-}
-
-type Metadata struct {
-	Uuid           string
-	FileName       string
-	Encryption     string
-	Authentication string
-	HMAC           string
-	IV             string
-	TotalSizeIn    uint64
-	TotalSize      uint64
-	Chunks         uint
-	FileType       string
-	Subvolume      string
-	Date           int64
-	Parent         string
-}
-
-type ChunkInfo struct {
-	Uuid           string
-	FileName       string
-	Encryption     string
-	Authentication string
-	IsData         bool
-	Chunk          uint
-}
-
-func Cleanup(folderId string, subvolume string) () {
-	log.Infof("Google Drive Cleanup...")
-	log.Info("Builing restore chain...")
-	chain := BuildChain(folderId, subvolume, false)
-
-	log.Info("Retrieving list of files...")
-	files, err := srv.Files.
-		List().
-		Fields("nextPageToken, files(id, properties)").
-		Q("'" + folderId + "' in parents AND trashed = false").
-		Do()
-	if err != nil {
-		log.Error(err)
-	}
-	log.Infof("Retrieving %d files", len(files.Files))
-
-	log.Info("Deleting files...")
-driveFiles:
-	for _, file := range files.Files {
-		log.Info(file.Properties["OZB_uuid"], file.Id)
-		if file.Properties["OZB_uuid"] == "" || file.Id == "" {
-			continue driveFiles // Failsafe
-		}
-		for _, snap := range chain {
-			if snap.Uuid == file.Properties["OZB_uuid"] {
-				continue driveFiles
-			}
-		}
-		log.Infof("Deleting %s", file.Id)
-		err := srv.Files.Delete(file.Id).Do()
-		if err != nil {
-			log.Error(err)
-		}
-	}
-
-	log.Infof("Google Drive Cleanup done!")
-}
-
-func BuildChain(folderId string, subvolume string, print bool) []Common.SnapshotWithSize {
-	latestUploaded, err := FindLatest(folderId, subvolume)
-	Common.PrintAndExitOnError(err, 1)
-
-	if latestUploaded == nil {
-		return []Common.SnapshotWithSize{}
-	}
-
-	latestUuid := latestUploaded.Properties["OZB_uuid"]
-	latestName := latestUploaded.Properties["OZB_filename"]
-
-	var chain []Common.SnapshotWithSize
-
-	for true {
-		fs, err := FetchMetadata(latestUuid, folderId)
-		if err != nil {
-			log.Fatal(err)
-		}
-		latestUuid = fs.Uuid
-		latestName = fs.FileName
-		latestParent := fs.Parent
-		downloadSize := fs.TotalSize
-		diskSize := fs.TotalSizeIn
-		snap := Common.SnapshotWithSize{Uuid: latestUuid, Filename: latestName, DownloadSize: downloadSize, DiskSize: diskSize}
-		if print {
-			log.Infof("snapshot: %s", latestName)
-		}
-		chain = append([]Common.SnapshotWithSize{snap}, chain...)
-		if latestParent == "" {
-			break
-		}
-
-		// fetch parent on next iteration
-		latestUuid = latestParent
-	}
-
-	return chain
-}
-
-func FetchMetadata(uuid string, parent string) (*Metadata, error) {
+func FetchMetadata(uuid string, parent string) (*Common.Metadata, error) {
 	var query = "trashed = false AND properties has { key='OZB_type' and value='metadata' } AND properties has { key='OZB_uuid' and value='" + uuid + "' }"
 	if parent != "" {
 		query = "'" + parent + "' in parents AND " + query
 	}
-	files, err := srv.Files.
-		List().
-		Fields("nextPageToken, files").
-		Q(query).
-		Do()
+	file, err := findFirst("id", query)
 	if err != nil {
 		return nil, err
 	}
 
-	var res *http.Response
-	for _, file := range files.Files {
-		res, err = srv.Files.Get(file.Id).Download()
-		break
+	if file == nil {
+		return nil, Common.E_NO_METADATA
 	}
+
+	res, err := srv.Files.Get(file.Id).SupportsAllDrives(true).Download()
 	if err != nil {
 		return nil, err
 	}
-	if res != nil {
-		defer res.Body.Close()
-	}
+	defer res.Body.Close()
 
 	marshalled, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	unmarshalled := &Metadata{}
-	json.Unmarshal(marshalled, unmarshalled)
+	unmarshalled := &Common.Metadata{}
+	err = json.Unmarshal(marshalled, unmarshalled)
 	if err != nil {
 		return nil, err
 	}
@@ -184,103 +63,61 @@ func FetchMetadata(uuid string, parent string) (*Metadata, error) {
 }
 
 func FindLatest(parent string, subvolume string) (*drive.File, error) {
-	files, err := srv.Files.
-		List().
-		Fields("nextPageToken, files").
-		Q("'" + parent + "' in parents AND trashed = false AND properties has { key='OZB_type' and value='latest' } AND properties has { key='OZB_subvolume' and value='" + subvolume + "' }").
-		Do()
-	if err != nil {
-		return nil, err
-	}
-
-	for _, file := range files.Files {
-		return file, nil
-	}
-
-	return nil, nil
-}
-
-func FetchLatest(parent string, subvolume string) (string, error) {
-	file, err := FindLatest(parent, subvolume)
-
-	if file.Id == "" {
-		return "", E_NO_LATEST
-	}
-
-	res, err := srv.Files.Get(file.Id).Download()
-	defer res.Body.Close()
-
-	latest, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return "", E_NO_LATEST
-	}
-
-	return string(latest), nil
+	return findFirst("id, properties", "'"+parent+"' in parents AND trashed = false AND properties has { key='OZB_type' and value='latest' } AND properties has { key='OZB_subvolume' and value='"+subvolume+"' }")
 }
 
-func UploadMetadata(meta *Metadata, parent string) *Metadata {
+func UploadMetadata(meta *Common.Metadata, parent string) error {
 	metaBytes, err := json.Marshal(meta)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	reader := bytes.NewReader(metaBytes)
 
 	parents := make([]string, 1)
 	parents[0] = parent
-	properties := make(map[string]string)
-	properties["OZB"] = "true"
-	properties["OZB_uuid"] = meta.Uuid
-	properties["OZB_filename"] = meta.FileName
-	properties["OZB_encryption"] = meta.Encryption
-	properties["OZB_authentication"] = meta.Authentication
-	properties["OZB_chunk"] = fmt.Sprintf("%d", meta.Chunks)
-	properties["OZB_storesize"] = fmt.Sprintf("%d", meta.TotalSize)
-	properties["OZB_filetype"] = meta.FileType
-	properties["OZB_subvolume"] = meta.Subvolume
-	properties["OZB_parent"] = meta.Parent
-	properties["OZB_date"] = fmt.Sprintf("%d", meta.Date)
-	properties["OZB_type"] = "metadata"
-	filename := fmt.Sprintf("%s|M", meta.Uuid)
-	_, err = srv.Files.Create(&drive.File{Name: filename, Parents: parents, Properties: properties}).Media(reader).Do()
+	properties := Common.MetadataProperties(meta)
+	filename := Common.MetadataFileName(meta.Uuid)
+
+	// Metadata is rewritten when its key slots change
+	file, err := findFirst("id", "'"+parent+"' in parents AND trashed = false AND properties has { key='OZB_type' and value='metadata' } AND properties has { key='OZB_uuid' and value='"+meta.Uuid+"' }")
 	if err != nil {
-		return nil
+		return err
+	}
+	if file != nil {
+		_, err = srv.Files.Update(file.Id, &drive.File{Name: filename, Properties: properties}).SupportsAllDrives(true).Media(reader).Do()
+		return err
 	}
 
-	return meta
-}
-func SaveLatest(snapshotname string, snapshotUUID string, subvolume string, folder string) (string, error) {
-	reader := bytes.NewReader([]byte(snapshotname))
+	_, err = srv.Files.Create(&drive.File{Name: filename, Parents: parents, Properties: properties}).SupportsAllDrives(true).Media(reader).Do()
 
-	properties := make(map[string]string)
-	properties["OZB"] = "true"
-	properties["OZB_uuid"] = snapshotUUID
-	properties["OZB_filename"] = snapshotname
-	properties["OZB_chunk"] = "0"
-	properties["OZB_storesize"] = fmt.Sprintf("%d", len(snapshotname))
-	properties["OZB_filetype"] = "latest"
-	properties["OZB_subvolume"] = subvolume
-	properties["OZB_date"] = fmt.Sprintf("%d", time.Now().Unix())
-	properties["OZB_type"] = "latest"
-	filename := fmt.Sprintf("%s|latest", subvolume)
+	return err
+}
 
-	var file *drive.File
+func SaveLatest(snapshotname string, snapshotUUID string, subvolume string, parent string) (string, error) {
+	reader := bytes.NewReader([]byte(snapshotname))
 
-	parent := FindOrCreateFolder(folder)
+	properties := Common.LatestProperties(&Common.Snapshot{Uuid: snapshotUUID, Filename: snapshotname}, subvolume)
+	filename := Common.LatestFileName(subvolume)
 
 	file, err := FindLatest(parent, subvolume)
+	if err != nil {
+		return "", err
+	}
 	if file == nil {
 		var parents []string
 		parents = append(parents, parent)
 		file, err = srv.
 			Files.
 			Create(&drive.File{Name: filename, Parents: parents, Properties: properties}).
+			SupportsAllDrives(true).
 			Media(reader).
 			Do()
 	} else {
 		file, err = srv.
 			Files.
 			Update(file.Id, &drive.File{Name: filename, Properties: properties}).
+			SupportsAllDrives(true).
 			Media(reader).
 			Do()
 	}
@@ -291,32 +128,46 @@ func SaveLatest(snapshotname string, snapshotUUID string, subvolume string, fold
 	return file.Id, nil
 }
 
-func Upload(meta *ChunkInfo, parent string, reader io.Reader, opt_wantedMD5 string) (*drive.File, error) {
+func Upload(meta *Common.ChunkInfo, parent string, reader io.Reader, opt_wantedMD5 string) (*drive.File, error) {
 	parents := make([]string, 1)
 	parents[0] = parent
-	properties := make(map[string]string)
-	properties["OZB"] = "true"
-	properties["OZB_uuid"] = meta.Uuid
-	properties["OZB_chunk"] = fmt.Sprintf("%d", meta.Chunk)
-	properties["OZB_type"] = "data"
-	filename := fmt.Sprintf("%s|%d", meta.Uuid, meta.Chunk)
-	file, err := srv.Files.Create(&drive.File{Name: filename, Parents: parents, Properties: properties}).Media(reader).Do()
+	properties := Common.ChunkProperties(meta)
+	filename := Common.ChunkFileName(meta.Uuid, meta.Chunk)
+	var file *drive.File
+	var err error
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		file, err = resumableUpload(&drive.File{Name: filename, Parents: parents, Properties: properties}, seeker, opt_wantedMD5)
+	} else {
+		file, err = srv.Files.Create(&drive.File{Name: filename, Parents: parents, Properties: properties}).SupportsAllDrives(true).Media(reader).Do()
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	// If we pass an empty hash, skip verification
-	if opt_wantedMD5 == "" {
-		return file, nil
+	if opt_wantedMD5 != "" {
+		googleDriveMD5, err := waitForMD5(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if googleDriveMD5 != opt_wantedMD5 {
+			return nil, Common.E_BACKEND_HASH_MISMATCH
+		}
 	}
 
-	googleDriveMD5 := ""
+	return file, nil
+}
+
+// waitForMD5 returns the MD5 of an uploaded file. Drive may take a while to calculate it.
+func waitForMD5(file *drive.File) (string, error) {
+	googleDriveMD5 := file.Md5Checksum
 
 	for googleDriveMD5 == "" {
 		// Re-fetch file, to have hashes and stuff
-		fileUpdate, err := srv.Files.Get(file.Id).Fields("md5Checksum, id").Do()
+		fileUpdate, err := srv.Files.Get(file.Id).SupportsAllDrives(true).Fields("md5Checksum, id").Do()
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 
 		googleDriveMD5 = fileUpdate.Md5Checksum
@@ -326,57 +177,20 @@ func Upload(meta *ChunkInfo, parent string, reader io.Reader, opt_wantedMD5 stri
 		}
 	}
 
-	if googleDriveMD5 != opt_wantedMD5 {
-		return nil, E_BACKEND_HASH_MISMATCH
-	}
-
-	return file, err
+	return googleDriveMD5, nil
 }
 
-func Download(fileId string, opt_wantedMD5 string, writer *os.File) (int64, error) {
-	_, err := writer.Seek(0, 0)
-	if err != nil {
-		return 0, err
-	}
-	err = writer.Truncate(0)
-	if err != nil {
-		return 0, err
-	}
-
+func Download(fileId string, writer io.Writer) (int64, error) {
 	res, err := srv.Files.
 		Get(fileId).
+		SupportsAllDrives(true).
 		Download()
 	if err != nil {
 		return 0, err
 	}
 	defer res.Body.Close()
 
-	hash := md5.New()
-	multiWriter := io.MultiWriter(writer, hash)
-
-	n, err := io.Copy(multiWriter, res.Body)
-	if err != nil {
-		return 0, err
-	}
-
-	writtenMD5 := fmt.Sprintf("%x", hash.Sum(nil))
-
-	// Empty opt_wantedMD5 = disable verification
-	if opt_wantedMD5 != "" && writtenMD5 != opt_wantedMD5 {
-		return 0, E_BACKEND_HASH_MISMATCH
-	}
-
-	err = writer.Sync()
-	if err != nil {
-		return 0, err
-	}
-
-	_, err = writer.Seek(0, 0)
-	if err != nil {
-		return 0, err
-	}
-
-	return n, err
+	return io.Copy(writer, res.Body)
 }
 
 type ParentFilter struct {
@@ -385,22 +199,41 @@ type ParentFilter struct {
 	Qualifying   []string
 }
 
+// findFirst returns the first file matching query, or nil if there is none.
+// Drive may return empty pages before the one holding a match, so it keeps paging.
+func findFirst(fields string, query string) (*drive.File, error) {
+	pageToken := ""
+	for {
+		fileList, err := filesList().
+			Fields(googleapi.Field("nextPageToken, files(" + fields + ")")).
+			Q(query).
+			PageToken(pageToken).
+			Do()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(fileList.Files) != 0 {
+			return fileList.Files[0], nil
+		}
+		if fileList.NextPageToken == "" {
+			return nil, nil
+		}
+		pageToken = fileList.NextPageToken
+	}
+}
+
 func findFileIdInParentId(wantedFileName string, parentID string) (string, error) {
-	fileList, err := srv.
-		Files.
-		List().
-		Fields("nextPageToken, files(id, name, parents)").
-		Q("name = '" + wantedFileName + "' AND '" + parentID + "' in parents AND trashed = false").
-		Do()
+	file, err := findFirst("id", "name = '"+wantedFileName+"' AND '"+parentID+"' in parents AND trashed = false")
 	if err != nil {
 		return "", err
 	}
 
-	for _, file := range fileList.Files {
-		return file.Id, nil
+	if file == nil {
+		return "", E_NOPARENT
 	}
 
-	return "", E_NOPARENT
+	return file.Id, nil
 }
 
 type folderSearch struct {
@@ -436,9 +269,8 @@ func FindInFolder(parentID string, fileType string, subvolume string, callback f
 		query += " AND properties has { key='OZB_subvolume' and value='" + subvolume + "' }"
 	}
 
-	err := srv.Files.
-		List().
-		Fields("nextPageToken, files").
+	err := filesList().
+		Fields("nextPageToken, files(id, properties)").
 		Q(query).
 		Pages(context.Background(), search.add)
 	if err != nil {
@@ -450,47 +282,33 @@ func FindInFolder(parentID string, fileType string, subvolume string, callback f
 
 // getClient uses a Context and Config to retrieve a Token
 // then generate a Client. It returns the generated Client.
-func getClient(ctx context.Context, config *oauth2.Config) *http.Client {
+// Refreshed tokens are written back to where the token came from.
+func getClient(ctx context.Context, config *oauth2.Config, vaultClient *vault.Client) *http.Client {
 	cacheFile, err := tokenCacheFile()
 	if err != nil {
 		log.Fatalf("Unable to get path to cached credential file. %v", err)
 	}
 
 	var tok *oauth2.Token
+	var persist func(*oauth2.Token) error
 	if len(secretsCache) != 0 {
 		tok, err = tokenFromSecretsCache()
 		if err != nil {
 			log.Fatal(err)
 		}
+		persist = vaultPersister(vaultClient, secretsCache)
 	} else {
 		tok, err = tokenFromFile(cacheFile)
 		if err != nil {
 			tok = getTokenFromWeb(config)
 			saveToken(cacheFile, tok)
 		}
+		persist = func(token *oauth2.Token) error {
+			return writeToken(cacheFile, token)
+		}
 	}
 
-	return config.Client(ctx, tok)
-}
-
-// getTokenFromWeb uses Config to request a Token.
-// It returns the retrieved Token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Fprintf(os.Stderr, "Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
-
-	var code string
-	if _, err := fmt.Scan(&code); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)
-	}
-
-	tok, err := config.Exchange(context.Background(), code)
-	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
-	}
-
-	return tok
+	return oauth2.NewClient(ctx, &persistingTokenSource{source: config.TokenSource(ctx, tok), last: tok, persist: persist})
 }
 
 // tokenCacheFile generates credential file path/filename.
@@ -536,13 +354,20 @@ func tokenFromFile(file string) (*oauth2.Token, error) {
 // saveToken uses a file path to create a file and store the
 // token in it.
 func saveToken(file string, token *oauth2.Token) {
-	fmt.Fprintf(os.Stderr, "Saving credential file to: %s", file)
-	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	fmt.Fprintf(os.Stderr, "Saving credential file to: %s\n", file)
+	err := writeToken(file, token)
 	if err != nil {
 		log.Fatalf("Unable to cache oauth token: %v", err)
 	}
+}
+
+func writeToken(file string, token *oauth2.Token) error {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
 	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+	return json.NewEncoder(f).Encode(token)
 }
 
 var srv *drive.Service
@@ -586,53 +411,69 @@ func getClientSecretFromFile() ([]byte, error) {
 	return b, err
 }
 
-func InitGoogleDrive(client *vault.Client) {
+// InitGoogleDrive authenticates with the service account in serviceAccountFile (or
+// 'serviceaccount.json' in Vault) if there is one, acting as subject if it is not empty.
+// Otherwise it uses the OAuth client secret and token of a user.
+func InitGoogleDrive(client *vault.Client, serviceAccountFile string, subject string) {
 	ctx := context.Background()
 
 	var b []byte
 	var err error
+	vaultFilled := false
 	if client != nil {
 		err = fillSecretsCache(client)
 		if err != nil {
 			log.Errorf("Could not fill secrets cache from Vault: %v", err)
-			b, err = getClientSecretFromFile() // fallback
 		} else {
+			vaultFilled = true
+		}
+	}
+
+	var driveClient *http.Client
+
+	serviceAccount, err := getServiceAccount(serviceAccountFile)
+	if err != nil {
+		log.Fatalf("Unable to read service account: %v", err)
+	}
+
+	if serviceAccount != nil {
+		driveClient, err = serviceAccountClient(ctx, serviceAccount, subject, drive.DriveFileScope)
+		if err != nil {
+			log.Fatalf("Unable to parse service account: %v", err)
+		}
+	} else {
+		if vaultFilled {
 			b, err = getClientSecretFromVault()
 			if err != nil {
 				log.Errorf("Could not get client secret from Vault: %v", err)
 				b, err = getClientSecretFromFile() // fallback
 			}
+		} else {
+			b, err = getClientSecretFromFile()
 		}
-	} else {
-		b, err = getClientSecretFromFile()
-	}
 
-	if err != nil {
-		log.Fatalf("Unable to read client secret: %v", err)
-	}
+		if err != nil {
+			log.Fatalf("Unable to read client secret: %v", err)
+		}
 
-	config, err := google.ConfigFromJSON(b, drive.DriveFileScope)
-	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+		config, err := google.ConfigFromJSON(b, drive.DriveFileScope)
+		if err != nil {
+			log.Fatalf("Unable to parse client secret file to config: %v", err)
+		}
+		driveClient = getClient(ctx, config, client)
 	}
-	driveClient := getClient(ctx, config)
 
 	secretsCache = make(map[string]string, 0)
 
+	httpClient = driveClient
 	srv, err = drive.New(driveClient)
 	if err != nil {
 		log.Fatalf("Unable to retrieve drive Client %v", err)
 	}
 }
 
-type Quota struct {
-	Limit     uint64
-	Used      uint64
-	Unlimited bool
-}
-
-func getQuota() (*Quota, error) {
-	q := Quota{}
+func getQuota() (*Common.Quota, error) {
+	q := Common.Quota{}
 	resp, err := srv.About.Get().Fields("storageQuota").Do()
 	if err != nil {
 		return nil, err
@@ -649,37 +490,13 @@ func getQuota() (*Quota, error) {
 }
 
 func createFolder(name string) (string, error) {
-	f := drive.File{Name: name, MimeType: "application/vnd.google-apps.folder"}
-	res, err := srv.Files.Create(&f).Fields("id").Do()
+	f := drive.File{Name: name, MimeType: FOLDER_MIME_TYPE, Parents: []string{rootId()}}
+	res, err := srv.Files.Create(&f).SupportsAllDrives(true).Fields("id").Do()
 	return res.Id, err
 }
 
-func ListFiles(parent string) {
-	files, err := FindInFolder(parent, "", "", func(file *drive.File) {
-		log.Infoln(file.Properties["OZB_date"])
-
-		size, _ := strconv.ParseUint(file.Properties["OZB_storesize"], 10, 64)
-		timestamp, _ := strconv.ParseInt(file.Properties["OZB_date"], 10, 64)
-
-		fmt.Fprintf(
-			os.Stderr,
-			"'%s'\n\t- Date: %s\n\t- UUID: %s\n\t- Enc.: %s\n\t- Auth: %s\n\t- Size: %s chunks, %s\n",
-			file.Properties["OZB_filename"],
-			time.Unix(timestamp, 0).UTC().String(),
-			file.Properties["OZB_uuid"],
-			strings.ToUpper(file.Properties["OZB_encryption"]),
-			strings.ToUpper(file.Properties["OZB_authentication"]),
-			file.Properties["OZB_chunk"],
-			humanize.IBytes(size),
-		)
-	})
-	if err != nil || files == nil {
-		log.Fatal(err)
-	}
-}
-
 func FindOrCreateFolder(name string) string {
-	parent, err := findFileIdInParentId(name, "root")
+	parent, err := findFileIdInParentId(name, rootId())
 	if err != nil {
 		if err == E_NOPARENT {
 			parent, err = createFolder(name)
@@ -690,18 +507,3 @@ func FindOrCreateFolder(name string) string {
 	}
 	return parent
 }
-
-func DisplayQuota() {
-	q, err := getQuota()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	var limit string
-	if q.Unlimited {
-		limit = "unlimited"
-	} else {
-		limit = humanize.IBytes(q.Limit)
-	}
-	log.Infof("Limit: %s, Used: %s", limit, humanize.IBytes(q.Used))
-}
@@ -0,0 +1,64 @@
+package Local
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"../Common"
+)
+
+// Filesystem is what Backend needs to store its files.
+// Files created with Create are synced before they are closed, if they implement Sync.
+type Filesystem interface {
+	Create(name string) (io.WriteCloser, error)
+	Open(name string) (io.ReadCloser, error)
+	// Rename has to replace newname if it exists.
+	Rename(oldname string, newname string) error
+	Remove(name string) error
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	MkdirAll(dirname string) error
+	Quota(dirname string) (*Common.Quota, error)
+}
+
+type osFilesystem struct{}
+
+func (osFilesystem) Create(name string) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+}
+
+func (osFilesystem) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (osFilesystem) Rename(oldname string, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFilesystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFilesystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+func (osFilesystem) MkdirAll(dirname string) error {
+	return os.MkdirAll(dirname, 0700)
+}
+
+func (osFilesystem) Quota(dirname string) (*Common.Quota, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dirname, &stat)
+	if err != nil {
+		return nil, err
+	}
+
+	// Blocks reserved for root are not available to backups
+	used := stat.Blocks - stat.Bfree
+	return &Common.Quota{
+		Limit: (used + stat.Bavail) * uint64(stat.Bsize),
+		Used:  used * uint64(stat.Bsize),
+	}, nil
+}
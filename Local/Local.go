@@ -0,0 +1,402 @@
+package Local
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"../Common"
+)
+
+const PROPERTIES_SUFFIX = ".properties"
+const TEMP_SUFFIX = ".tmp"
+
+// sidecar holds what Google Drive stores alongside a file.
+// It is written next to every file as `<name>.properties`.
+type sidecar struct {
+	Name        string
+	Size        int64
+	Md5Checksum string
+	Properties  map[string]string
+}
+
+// Backend stores snapshots in a directory, e.g. an NFS mount or a USB disk.
+type Backend struct {
+	fs  Filesystem
+	dir string
+	// Re-read every chunk after writing it. Too expensive for remote filesystems.
+	verifyByReading bool
+}
+
+func NewBackend(dir string) (*Backend, error) {
+	return NewFilesystemBackend(osFilesystem{}, dir, true)
+}
+
+// NewFilesystemBackend stores snapshots in dir on fs. Without verifyByReading a
+// chunk is only verified against the data that was sent.
+func NewFilesystemBackend(fs Filesystem, dir string, verifyByReading bool) (*Backend, error) {
+	err := fs.MkdirAll(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{fs: fs, dir: dir, verifyByReading: verifyByReading}, nil
+}
+
+// Subvolumes like "tank/data" must not create subdirectories
+var escaper = strings.NewReplacer("%", "%25", "/", "%2F")
+var unescaper = strings.NewReplacer("%2F", "/", "%25", "%")
+
+func (this *Backend) fileName(name string) string {
+	return filepath.Join(this.dir, escaper.Replace(name))
+}
+
+// put atomically writes the content of reader and its sidecar and returns the MD5 of what was written.
+func (this *Backend) put(name string, reader io.Reader, properties map[string]string) (string, error) {
+	path := this.fileName(name)
+
+	file, err := this.fs.Create(path + TEMP_SUFFIX)
+	if err != nil {
+		return "", err
+	}
+	defer this.fs.Remove(path + TEMP_SUFFIX)
+
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), reader)
+	if err != nil {
+		file.Close()
+		return "", err
+	}
+	if syncer, ok := file.(interface{ Sync() error }); ok {
+		err = syncer.Sync()
+		if err != nil {
+			file.Close()
+			return "", err
+		}
+	}
+	err = file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	// The sidecar goes first, so an interrupted put still gets picked up by a cleanup
+	fileMD5 := fmt.Sprintf("%x", hash.Sum(nil))
+	err = this.writeSidecar(name, &sidecar{Name: name, Size: size, Md5Checksum: fileMD5, Properties: properties})
+	if err != nil {
+		return "", err
+	}
+
+	return fileMD5, this.fs.Rename(path+TEMP_SUFFIX, path)
+}
+
+func (this *Backend) writeSidecar(name string, side *sidecar) error {
+	path := this.fileName(name) + PROPERTIES_SUFFIX
+
+	marshalled, err := json.Marshal(side)
+	if err != nil {
+		return err
+	}
+
+	file, err := this.fs.Create(path + TEMP_SUFFIX)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(marshalled)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return this.fs.Rename(path+TEMP_SUFFIX, path)
+}
+
+func (this *Backend) readFile(name string) ([]byte, error) {
+	file, err := this.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+func (this *Backend) readSidecar(name string) (*sidecar, error) {
+	marshalled, err := this.readFile(this.fileName(name) + PROPERTIES_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	side := &sidecar{}
+	err = json.Unmarshal(marshalled, side)
+	if err != nil {
+		return nil, err
+	}
+
+	return side, nil
+}
+
+// sidecars calls callback for every sidecar in the directory.
+func (this *Backend) sidecars(callback func(*sidecar)) error {
+	entries, err := this.fs.ReadDir(this.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), PROPERTIES_SUFFIX) {
+			continue
+		}
+		name := unescaper.Replace(strings.TrimSuffix(entry.Name(), PROPERTIES_SUFFIX))
+		side, err := this.readSidecar(name)
+		if err != nil {
+			return err
+		}
+		callback(side)
+	}
+
+	return nil
+}
+
+// hashFile re-reads a file from disk, so we know what actually got stored.
+func (this *Backend) hashFile(name string) (string, error) {
+	file, err := this.fs.Open(this.fileName(name))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+func (this *Backend) ClassifyError(err error) *Common.ErrorClass {
+	if classifier, ok := this.fs.(Common.ErrorClassifier); ok {
+		class := classifier.ClassifyError(err)
+		if class != nil {
+			return class
+		}
+	}
+
+	if os.IsNotExist(err) || os.IsPermission(err) || errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EROFS) || errors.Is(err, syscall.EDQUOT) {
+		return &Common.ErrorClass{Permanent: true}
+	}
+	return nil
+}
+
+func (this *Backend) PutChunk(info *Common.ChunkInfo, reader io.Reader, wantedMD5 string) error {
+	name := Common.ChunkFileName(info.Uuid, info.Chunk)
+
+	storedMD5, err := this.put(name, reader, Common.ChunkProperties(info))
+	if err != nil {
+		return err
+	}
+
+	// If we pass an empty hash, skip verification
+	if wantedMD5 == "" {
+		return nil
+	}
+
+	if this.verifyByReading {
+		storedMD5, err = this.hashFile(name)
+		if err != nil {
+			return err
+		}
+	}
+	if storedMD5 != wantedMD5 {
+		return Common.E_BACKEND_HASH_MISMATCH
+	}
+
+	return nil
+}
+
+// StreamChunk writes the chunk without knowing its MD5 beforehand.
+func (this *Backend) StreamChunk(info *Common.ChunkInfo, reader io.Reader) (string, error) {
+	name := Common.ChunkFileName(info.Uuid, info.Chunk)
+
+	storedMD5, err := this.put(name, reader, Common.ChunkProperties(info))
+	if err != nil {
+		return "", err
+	}
+
+	if this.verifyByReading {
+		return this.hashFile(name)
+	}
+	return storedMD5, nil
+}
+
+func (this *Backend) ListChunks(uuid string) ([]*Common.RemoteChunk, error) {
+	var chunks []*Common.RemoteChunk
+
+	err := this.sidecars(func(side *sidecar) {
+		if side.Properties["OZB_type"] != "data" || side.Properties["OZB_uuid"] != uuid {
+			return
+		}
+		raw, err := strconv.ParseUint(side.Properties["OZB_chunk"], 10, 32)
+		if err != nil {
+			return
+		}
+		chunks = append(chunks, &Common.RemoteChunk{Id: side.Name, Chunk: uint(raw), MD5: side.Md5Checksum, Size: side.Size})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return chunks, nil
+}
+
+func (this *Backend) GetChunk(chunk *Common.RemoteChunk, writer io.Writer) (int64, error) {
+	file, err := this.fs.Open(this.fileName(chunk.Id))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return io.Copy(writer, file)
+}
+
+func (this *Backend) PutMetadata(meta *Common.Metadata) error {
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	_, err = this.put(Common.MetadataFileName(meta.Uuid), bytes.NewReader(metaBytes), Common.MetadataProperties(meta))
+	return err
+}
+
+func (this *Backend) GetMetadata(uuid string) (*Common.Metadata, error) {
+	marshalled, err := this.readFile(this.fileName(Common.MetadataFileName(uuid)))
+	if os.IsNotExist(err) {
+		return nil, Common.E_NO_METADATA
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	unmarshalled := &Common.Metadata{}
+	err = json.Unmarshal(marshalled, unmarshalled)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalled, nil
+}
+
+func (this *Backend) ListMetadata(fileType string, subvolume string, callback func(*Common.Metadata)) error {
+	return this.sidecars(func(side *sidecar) {
+		if side.Properties["OZB_type"] != "metadata" {
+			return
+		}
+		if fileType != "" && side.Properties["OZB_filetype"] != fileType {
+			return
+		}
+		if subvolume != "" && side.Properties["OZB_subvolume"] != subvolume {
+			return
+		}
+		callback(Common.MetadataFromProperties(side.Properties))
+	})
+}
+
+func (this *Backend) GetLatest(subvolume string) (*Common.Snapshot, error) {
+	side, err := this.readSidecar(Common.LatestFileName(subvolume))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Common.Snapshot{Uuid: side.Properties["OZB_uuid"], Filename: side.Properties["OZB_filename"]}, nil
+}
+
+func (this *Backend) SetLatest(subvolume string, latest *Common.Snapshot) error {
+	_, err := this.put(Common.LatestFileName(subvolume), strings.NewReader(latest.Filename), Common.LatestProperties(latest, subvolume))
+	return err
+}
+
+func (this *Backend) ListUuids() ([]string, error) {
+	seen := make(map[string]bool)
+	var uuids []string
+
+	err := this.sidecars(func(side *sidecar) {
+		uuid := side.Properties["OZB_uuid"]
+		if uuid == "" || seen[uuid] {
+			return
+		}
+		seen[uuid] = true
+		uuids = append(uuids, uuid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return uuids, nil
+}
+
+func (this *Backend) Delete(uuid string) error {
+	entries, err := this.fs.ReadDir(this.dir)
+	if err != nil {
+		return err
+	}
+
+	// Files of a snapshot are found by name, only latest pointers need their sidecar read
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), PROPERTIES_SUFFIX) {
+			continue
+		}
+		name := unescaper.Replace(strings.TrimSuffix(entry.Name(), PROPERTIES_SUFFIX))
+		if strings.HasSuffix(name, "|latest") {
+			side, err := this.readSidecar(name)
+			if err != nil {
+				return err
+			}
+			if side.Properties["OZB_uuid"] != uuid {
+				continue
+			}
+		} else if !strings.HasPrefix(name, uuid+"|") {
+			continue
+		}
+
+		err = this.remove(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remove removes a file and its sidecar.
+func (this *Backend) remove(name string) error {
+	// Remove the data first, so a leftover sidecar still marks it for the next cleanup
+	err := this.fs.Remove(this.fileName(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = this.fs.Remove(this.fileName(name) + PROPERTIES_SUFFIX)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (this *Backend) Quota() (*Common.Quota, error) {
+	return this.fs.Quota(this.dir)
+}
@@ -0,0 +1,276 @@
+package Local
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"../Common"
+)
+
+func newTestBackend(t *testing.T) (*Backend, string) {
+	dir := t.TempDir()
+	backend, err := NewBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend, dir
+}
+
+func putChunk(t *testing.T, backend *Backend, uuid string, chunk uint, data []byte) {
+	info := &Common.ChunkInfo{Uuid: uuid, FileName: "tank/data@" + uuid, IsData: true, Chunk: chunk}
+	err := backend.PutChunk(info, bytes.NewReader(data), fmt.Sprintf("%x", md5.Sum(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func putSnapshot(t *testing.T, backend *Backend, uuid string, subvolume string) {
+	putChunk(t, backend, uuid, 0, []byte("chunk 0 of "+uuid))
+	putChunk(t, backend, uuid, 1, []byte("chunk 1 of "+uuid))
+	err := backend.PutMetadata(&Common.Metadata{Uuid: uuid, FileName: subvolume + "@" + uuid, FileType: "zfs", Subvolume: subvolume, Chunks: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func listUuids(t *testing.T, backend *Backend) []string {
+	uuids, err := backend.ListUuids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(uuids)
+	return uuids
+}
+
+func TestChunks(t *testing.T) {
+	backend, dir := newTestBackend(t)
+	putChunk(t, backend, "u1", 0, []byte("first"))
+	putChunk(t, backend, "u1", 1, []byte("second"))
+
+	chunks, err := backend.ListChunks("u1")
+	if err != nil || len(chunks) != 2 {
+		t.Fatalf("ListChunks returned %v, %v", chunks, err)
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Chunk < chunks[j].Chunk })
+	for i, data := range []string{"first", "second"} {
+		chunk := chunks[i]
+		if chunk.Chunk != uint(i) || chunk.Size != int64(len(data)) || chunk.MD5 != fmt.Sprintf("%x", md5.Sum([]byte(data))) {
+			t.Errorf("chunk %d listed as %+v", i, chunk)
+		}
+		var got bytes.Buffer
+		_, err = backend.GetChunk(chunk, &got)
+		if err != nil || got.String() != data {
+			t.Errorf("GetChunk of chunk %d returned %q, %v", i, got.String(), err)
+		}
+	}
+
+	// The sidecar holds what Drive would store alongside the file
+	side, err := backend.readSidecar(Common.ChunkFileName("u1", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if side.Name != "u1|1" || side.Size != 6 || side.Properties["OZB_uuid"] != "u1" || side.Properties["OZB_chunk"] != "1" || side.Properties["OZB_type"] != "data" {
+		t.Errorf("sidecar is %+v", side)
+	}
+
+	// Nothing is left behind but the files and their sidecars
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("directory holds %d entries, want 4", len(entries))
+	}
+
+	err = backend.PutChunk(&Common.ChunkInfo{Uuid: "u1", Chunk: 2}, bytes.NewReader([]byte("third")), fmt.Sprintf("%x", md5.Sum(nil)))
+	if err != Common.E_BACKEND_HASH_MISMATCH {
+		t.Errorf("PutChunk with a wrong MD5 returned %v", err)
+	}
+
+	streamed, err := backend.StreamChunk(&Common.ChunkInfo{Uuid: "u2", Chunk: 0}, bytes.NewReader([]byte("streamed")))
+	if err != nil || streamed != fmt.Sprintf("%x", md5.Sum([]byte("streamed"))) {
+		t.Errorf("StreamChunk returned %q, %v", streamed, err)
+	}
+}
+
+func TestMetadataAndLatest(t *testing.T) {
+	backend, dir := newTestBackend(t)
+
+	_, err := backend.GetMetadata("u1")
+	if err != Common.E_NO_METADATA {
+		t.Fatalf("GetMetadata of a missing snapshot returned %v", err)
+	}
+	latest, err := backend.GetLatest("tank/data")
+	if err != nil || latest != nil {
+		t.Fatalf("GetLatest without snapshots returned %v, %v", latest, err)
+	}
+
+	// Subvolumes contain slashes and may contain the escape character
+	for _, subvolume := range []string{"tank/data", "tank/100%2F"} {
+		putSnapshot(t, backend, "u-"+subvolume[5:], subvolume)
+		err = backend.SetLatest(subvolume, &Common.Snapshot{Uuid: "u-" + subvolume[5:], Filename: subvolume + "@1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, subvolume := range []string{"tank/data", "tank/100%2F"} {
+		latest, err = backend.GetLatest(subvolume)
+		if err != nil || latest == nil || latest.Uuid != "u-"+subvolume[5:] || latest.Filename != subvolume+"@1" {
+			t.Errorf("GetLatest(%q) returned %+v, %v", subvolume, latest, err)
+		}
+
+		var listed []string
+		err = backend.ListMetadata("zfs", subvolume, func(meta *Common.Metadata) {
+			listed = append(listed, meta.Uuid)
+		})
+		if err != nil || len(listed) != 1 || listed[0] != "u-"+subvolume[5:] {
+			t.Errorf("ListMetadata of %q listed %v, %v", subvolume, listed, err)
+		}
+	}
+
+	meta, err := backend.GetMetadata("u-data")
+	if err != nil || meta.FileName != "tank/data@u-data" || meta.Chunks != 2 {
+		t.Errorf("GetMetadata returned %+v, %v", meta, err)
+	}
+
+	// No subdirectories, even for subvolumes
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			t.Errorf("created the directory %s", entry.Name())
+		}
+	}
+	_, err = os.Stat(filepath.Join(dir, "tank%2F100%252F|latest"))
+	if err != nil {
+		t.Errorf("latest pointer is not escaped: %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	backend, _ := newTestBackend(t)
+	// u1 is a prefix of u10, which must stay
+	for _, uuid := range []string{"u1", "u10", "u2"} {
+		putSnapshot(t, backend, uuid, "tank/"+uuid)
+	}
+	for _, uuid := range []string{"u1", "u10"} {
+		err := backend.SetLatest("tank/"+uuid, &Common.Snapshot{Uuid: uuid, Filename: "tank/" + uuid + "@1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := backend.Delete("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uuids := listUuids(t, backend); len(uuids) != 2 || uuids[0] != "u10" || uuids[1] != "u2" {
+		t.Errorf("ListUuids after Delete returned %v", uuids)
+	}
+	chunks, err := backend.ListChunks("u10")
+	if err != nil || len(chunks) != 2 {
+		t.Errorf("ListChunks of the remaining snapshot returned %v, %v", chunks, err)
+	}
+	latest, err := backend.GetLatest("tank/u1")
+	if err != nil || latest != nil {
+		t.Errorf("latest pointer of the deleted snapshot is %+v, %v", latest, err)
+	}
+	latest, err = backend.GetLatest("tank/u10")
+	if err != nil || latest == nil {
+		t.Errorf("latest pointer of another snapshot is %+v, %v", latest, err)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	backend, dir := newTestBackend(t)
+	putSnapshot(t, backend, "u1", "tank/data")
+	putSnapshot(t, backend, "u2", "tank/data")
+	err := backend.SetLatest("tank/data", &Common.Snapshot{Uuid: "u1", Filename: "tank/data@u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uuid := range []string{"u1", "u2"} {
+		err = backend.Quarantine(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if uuids := listUuids(t, backend); len(uuids) != 0 {
+		t.Errorf("quarantined snapshots are still listed: %v", uuids)
+	}
+	quarantined, err := backend.ListQuarantined()
+	if err != nil || len(quarantined) != 2 || quarantined["u1"].IsZero() {
+		t.Errorf("ListQuarantined returned %v, %v", quarantined, err)
+	}
+	_, err = os.Stat(filepath.Join(dir, QUARANTINE_DIR, "u1|0"))
+	if err != nil {
+		t.Errorf("chunk was not moved into quarantine: %v", err)
+	}
+
+	// A latest pointer set in the meantime is kept
+	err = backend.SetLatest("tank/data", &Common.Snapshot{Uuid: "u3", Filename: "tank/data@u3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.RestoreQuarantined("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuids := listUuids(t, backend); len(uuids) != 2 || uuids[0] != "u1" || uuids[1] != "u3" {
+		t.Errorf("ListUuids after restoring returned %v", uuids)
+	}
+	latest, err := backend.GetLatest("tank/data")
+	if err != nil || latest == nil || latest.Uuid != "u3" {
+		t.Errorf("restoring replaced the newer latest pointer: %+v, %v", latest, err)
+	}
+	side, err := backend.readSidecar("u1|0")
+	if err != nil || side.Properties["OZB_quarantined"] != "" {
+		t.Errorf("restored sidecar is %+v, %v", side, err)
+	}
+	var got bytes.Buffer
+	_, err = backend.GetChunk(&Common.RemoteChunk{Id: "u1|0"}, &got)
+	if err != nil || got.String() != "chunk 0 of u1" {
+		t.Errorf("GetChunk after restoring returned %q, %v", got.String(), err)
+	}
+
+	err = backend.Purge("u2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quarantined, err = backend.ListQuarantined()
+	if err != nil || len(quarantined) != 0 {
+		t.Errorf("ListQuarantined after purging returned %v, %v", quarantined, err)
+	}
+	// The quarantined latest pointer of u1 was dropped when it was restored, as a newer one
+	// existed, so nothing is left
+	entries, err := ioutil.ReadDir(filepath.Join(dir, QUARANTINE_DIR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("%s was left in quarantine", entry.Name())
+	}
+}
+
+func TestQuota(t *testing.T) {
+	backend, _ := newTestBackend(t)
+
+	quota, err := backend.Quota()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.Unlimited || quota.Limit == 0 || quota.Used > quota.Limit {
+		t.Errorf("Quota returned %+v", quota)
+	}
+}
@@ -0,0 +1,115 @@
+package Local
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Quarantined files are kept in this subdirectory, with the time they were moved there
+// added to their sidecar. Sidecars in subdirectories are not listed.
+const QUARANTINE_DIR = "quarantine"
+
+// quarantine is the backend of the quarantine directory.
+func (this *Backend) quarantine() (*Backend, error) {
+	return NewFilesystemBackend(this.fs, filepath.Join(this.dir, QUARANTINE_DIR), this.verifyByReading)
+}
+
+// move moves the files of uuid from this backend to target. The sidecar is written first and
+// removed last, so an interrupted move leaves the files listed in at least one of both.
+// Files that already exist in target are kept there.
+func (this *Backend) move(uuid string, target *Backend, properties map[string]string) error {
+	var sides []*sidecar
+
+	err := this.sidecars(func(side *sidecar) {
+		if side.Properties["OZB_uuid"] == uuid {
+			sides = append(sides, side)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, side := range sides {
+		_, err = target.readSidecar(side.Name)
+		if err == nil {
+			err = this.remove(side.Name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		for k, v := range properties {
+			if v == "" {
+				delete(side.Properties, k)
+			} else {
+				side.Properties[k] = v
+			}
+		}
+		err = target.writeSidecar(side.Name, side)
+		if err != nil {
+			return err
+		}
+		err = this.fs.Rename(this.fileName(side.Name), target.fileName(side.Name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = this.fs.Remove(this.fileName(side.Name) + PROPERTIES_SUFFIX)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *Backend) Quarantine(uuid string) error {
+	quarantine, err := this.quarantine()
+	if err != nil {
+		return err
+	}
+	return this.move(uuid, quarantine, map[string]string{"OZB_quarantined": strconv.FormatInt(time.Now().Unix(), 10)})
+}
+
+func (this *Backend) ListQuarantined() (map[string]time.Time, error) {
+	quarantine, err := this.quarantine()
+	if err != nil {
+		return nil, err
+	}
+
+	quarantined := make(map[string]time.Time)
+	err = quarantine.sidecars(func(side *sidecar) {
+		uuid := side.Properties["OZB_uuid"]
+		since, _ := strconv.ParseInt(side.Properties["OZB_quarantined"], 10, 64)
+		if uuid == "" {
+			return
+		}
+		// The last file moved counts
+		if at := time.Unix(since, 0); at.After(quarantined[uuid]) {
+			quarantined[uuid] = at
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return quarantined, nil
+}
+
+func (this *Backend) RestoreQuarantined(uuid string) error {
+	quarantine, err := this.quarantine()
+	if err != nil {
+		return err
+	}
+	return quarantine.move(uuid, this, map[string]string{"OZB_quarantined": ""})
+}
+
+func (this *Backend) Purge(uuid string) error {
+	quarantine, err := this.quarantine()
+	if err != nil {
+		return err
+	}
+	return quarantine.Delete(uuid)
+}
@@ -0,0 +1,112 @@
+package S3
+
+import (
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go"
+)
+
+// Quarantined objects are kept below this prefix inside the folder and are not listed
+// with the other objects. Copying an object sets its LastModified, which is used as the
+// time it was quarantined. Like StreamChunk, this works for objects up to 5 GiB.
+const QUARANTINE_PREFIX = "quarantine/"
+
+// move copies the objects of uuid from below one prefix to another and removes them there.
+// Objects that already exist at the destination are kept.
+func (this *Backend) move(uuid string, from string, to string) error {
+	var names []string
+
+	err := this.list(from+uuid+"|", func(name string, info minio.ObjectInfo) {
+		names = append(names, strings.TrimPrefix(name, from))
+	})
+	if err != nil {
+		return err
+	}
+
+	pointers, err := this.pointersTo(uuid, from)
+	if err != nil {
+		return err
+	}
+	if len(pointers) > 0 {
+		defer this.forgetPointers()
+	}
+	for _, name := range pointers {
+		names = append(names, strings.TrimPrefix(name, from))
+	}
+
+	for _, name := range names {
+		_, err = this.stat(to + name)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		if err != nil {
+			_, err = this.core.CopyObject(this.bucket, this.key(from+name), this.bucket, this.key(to+name), map[string]string{})
+			if err != nil {
+				return err
+			}
+		}
+
+		err = this.core.RemoveObject(this.bucket, this.key(from+name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *Backend) Quarantine(uuid string) error {
+	return this.move(uuid, "", QUARANTINE_PREFIX)
+}
+
+func (this *Backend) ListQuarantined() (map[string]time.Time, error) {
+	quarantined := make(map[string]time.Time)
+
+	err := this.list(QUARANTINE_PREFIX, func(name string, info minio.ObjectInfo) {
+		name = strings.TrimPrefix(name, QUARANTINE_PREFIX)
+		if !strings.Contains(name, "|") || strings.HasSuffix(name, "|latest") {
+			return
+		}
+		uuid := strings.SplitN(name, "|", 2)[0]
+		// The last object moved counts
+		if info.LastModified.After(quarantined[uuid]) {
+			quarantined[uuid] = info.LastModified
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return quarantined, nil
+}
+
+func (this *Backend) RestoreQuarantined(uuid string) error {
+	return this.move(uuid, QUARANTINE_PREFIX, "")
+}
+
+func (this *Backend) Purge(uuid string) error {
+	var names []string
+
+	err := this.list(QUARANTINE_PREFIX+uuid+"|", func(name string, info minio.ObjectInfo) {
+		names = append(names, name)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Quarantined latest pointers of the snapshot go as well
+	pointers, err := this.pointersTo(uuid, QUARANTINE_PREFIX)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range append(names, pointers...) {
+		err = this.core.RemoveObject(this.bucket, this.key(name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,545 @@
+package S3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../Common"
+	"github.com/minio/minio-go"
+	"github.com/prometheus/common/log"
+)
+
+// Parts of a multipart upload are buffered in memory to calculate their Content-MD5.
+const PART_SIZE = 16 * 1024 * 1024
+
+const META_PREFIX = "X-Amz-Meta-"
+
+// Metadata objects stat'ed at the same time, as listings carry no user metadata.
+const STAT_CONCURRENCY = 16
+
+// Backend stores snapshots as objects below a prefix in an S3 bucket.
+// Works with AWS, MinIO, Ceph RGW and other S3-compatible object storages.
+type Backend struct {
+	core   *minio.Core
+	bucket string
+	prefix string
+	// Guards pointers
+	lock sync.Mutex
+	// Names of the latest pointers below the folder and below QUARANTINE_PREFIX, once listed
+	pointers map[string][]string
+}
+
+func NewBackend(endpoint string, accessKey string, secretKey string, secure bool, region string, bucket string, folder string) (*Backend, error) {
+	client, err := minio.NewWithRegion(endpoint, accessKey, secretKey, secure, region)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		log.Infof("Creating bucket '%s'...", bucket)
+		err = client.MakeBucket(bucket, region)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	prefix := strings.Trim(folder, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &Backend{core: &minio.Core{Client: client}, bucket: bucket, prefix: prefix, pointers: make(map[string][]string)}, nil
+}
+
+// S3 user metadata travels as HTTP headers. Some proxies drop headers containing
+// underscores, so OZB_uuid is stored as X-Amz-Meta-Ozb-Uuid.
+func toUserMetadata(properties map[string]string) map[string]string {
+	metadata := make(map[string]string)
+	for key, value := range properties {
+		metadata[strings.Replace(strings.ToLower(key), "_", "-", -1)] = value
+	}
+	return metadata
+}
+
+func fromObjectInfo(info minio.ObjectInfo) map[string]string {
+	properties := make(map[string]string)
+	for key, values := range info.Metadata {
+		if !strings.HasPrefix(key, META_PREFIX) || len(values) == 0 {
+			continue
+		}
+		key = strings.Replace(strings.ToLower(strings.TrimPrefix(key, META_PREFIX)), "-", "_", -1)
+		if strings.HasPrefix(key, "ozb") {
+			key = "OZB" + strings.TrimPrefix(key, "ozb")
+		}
+		properties[key] = values[0]
+	}
+	return properties
+}
+
+func (this *Backend) ClassifyError(err error) *Common.ErrorClass {
+	response := minio.ToErrorResponse(err)
+	switch {
+	case response.StatusCode == 0:
+		// Not an answer of S3, e.g. a network error
+		return nil
+	case response.Code == "SlowDown" || response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable:
+		return &Common.ErrorClass{Wait: 30 * time.Second}
+	case response.StatusCode >= 500 || response.Code == "RequestTimeout":
+		return &Common.ErrorClass{}
+	default:
+		// Access denied, missing bucket or object, quota exceeded
+		return &Common.ErrorClass{Permanent: true}
+	}
+}
+
+func (this *Backend) key(name string) string {
+	return this.prefix + name
+}
+
+// put uploads reader as one object. Anything larger than PART_SIZE is uploaded as multipart upload.
+// Every request carries a Content-MD5, so S3 rejects data that was corrupted on the way.
+// ETags are not checked, as they are no MD5s with SSE-KMS or SSE-C.
+// It returns the MD5 of the whole object.
+func (this *Backend) put(name string, reader io.Reader, properties map[string]string) (string, error) {
+	key := this.key(name)
+	metadata := toUserMetadata(properties)
+
+	whole := md5.New()
+	buffer := make([]byte, PART_SIZE)
+
+	n, err := io.ReadFull(reader, buffer)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Fits into a single PUT
+		partMD5 := md5.Sum(buffer[:n])
+		whole.Write(buffer[:n])
+		_, err := this.core.PutObject(this.bucket, key, bytes.NewReader(buffer[:n]), int64(n), base64.StdEncoding.EncodeToString(partMD5[:]), "", metadata, nil)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%x", whole.Sum(nil)), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	uploadID, err := this.core.NewMultipartUpload(this.bucket, key, minio.PutObjectOptions{UserMetadata: metadata})
+	if err != nil {
+		return "", err
+	}
+
+	var parts []minio.CompletePart
+	for partID := 1; n > 0; partID++ {
+		partMD5 := md5.Sum(buffer[:n])
+		whole.Write(buffer[:n])
+		part, err := this.core.PutObjectPart(this.bucket, key, uploadID, partID, bytes.NewReader(buffer[:n]), int64(n), base64.StdEncoding.EncodeToString(partMD5[:]), "", nil)
+		if err != nil {
+			this.core.AbortMultipartUpload(this.bucket, key, uploadID)
+			return "", err
+		}
+		parts = append(parts, minio.CompletePart{PartNumber: partID, ETag: part.ETag})
+
+		n, err = io.ReadFull(reader, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			this.core.AbortMultipartUpload(this.bucket, key, uploadID)
+			return "", err
+		}
+	}
+
+	_, err = this.core.CompleteMultipartUpload(this.bucket, key, uploadID, parts)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", whole.Sum(nil)), nil
+}
+
+func (this *Backend) get(name string) ([]byte, error) {
+	object, err := this.core.Client.GetObject(this.bucket, this.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	return ioutil.ReadAll(object)
+}
+
+func (this *Backend) stat(name string) (map[string]string, error) {
+	info, err := this.core.StatObject(this.bucket, this.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return fromObjectInfo(info), nil
+}
+
+func isNotFound(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+// list calls callback for the name of every object starting with prefix.
+// Quarantined objects are skipped, unless prefix is below QUARANTINE_PREFIX.
+func (this *Backend) list(prefix string, callback func(name string, info minio.ObjectInfo)) error {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	for info := range this.core.Client.ListObjectsV2(this.bucket, this.key(prefix), true, doneCh) {
+		if info.Err != nil {
+			return info.Err
+		}
+		name := strings.TrimPrefix(info.Key, this.prefix)
+		// Quarantined objects are only listed when asked for
+		if strings.HasPrefix(name, QUARANTINE_PREFIX) && !strings.HasPrefix(prefix, QUARANTINE_PREFIX) {
+			continue
+		}
+		callback(name, info)
+	}
+
+	return nil
+}
+
+func (this *Backend) PutChunk(info *Common.ChunkInfo, reader io.Reader, wantedMD5 string) error {
+	// The MD5 is only known after the upload, so it is stored the same way as when streaming
+	if wantedMD5 == "" {
+		_, err := this.StreamChunk(info, reader)
+		return err
+	}
+
+	properties := Common.ChunkProperties(info)
+	// Multipart ETags are no MD5s. Keep the MD5 of the chunk around for downloads.
+	properties["OZB_md5"] = wantedMD5
+
+	uploadedMD5, err := this.put(Common.ChunkFileName(info.Uuid, info.Chunk), reader, properties)
+	if err != nil {
+		return err
+	}
+
+	if uploadedMD5 != wantedMD5 {
+		return Common.E_BACKEND_HASH_MISMATCH
+	}
+
+	return nil
+}
+
+// StreamChunk uploads the chunk as it is read. Its MD5 is only known afterwards, so
+// it is added by copying the object onto itself. This works for chunks up to 5 GiB.
+func (this *Backend) StreamChunk(info *Common.ChunkInfo, reader io.Reader) (string, error) {
+	name := Common.ChunkFileName(info.Uuid, info.Chunk)
+	properties := Common.ChunkProperties(info)
+
+	uploadedMD5, err := this.put(name, reader, properties)
+	if err != nil {
+		return "", err
+	}
+
+	properties["OZB_md5"] = uploadedMD5
+	headers := map[string]string{"X-Amz-Metadata-Directive": "REPLACE"}
+	for key, value := range toUserMetadata(properties) {
+		headers[META_PREFIX+key] = value
+	}
+	_, err = this.core.CopyObject(this.bucket, this.key(name), this.bucket, this.key(name), headers)
+	if err != nil {
+		return "", err
+	}
+
+	return uploadedMD5, nil
+}
+
+// ListChunks only needs the listing, as chunk numbers are part of the object names.
+// The MD5 of a chunk is stored as user metadata, which listings do not carry. It is set
+// by GetChunk or can be asked for with ChunkMD5.
+func (this *Backend) ListChunks(uuid string) ([]*Common.RemoteChunk, error) {
+	var chunks []*Common.RemoteChunk
+
+	var err error
+	listErr := this.list(uuid+"|", func(name string, info minio.ObjectInfo) {
+		if strings.HasSuffix(name, "|M") || err != nil {
+			return
+		}
+		var raw uint64
+		raw, err = strconv.ParseUint(strings.TrimPrefix(name, uuid+"|"), 10, 32)
+		chunks = append(chunks, &Common.RemoteChunk{Id: name, Chunk: uint(raw), Size: info.Size})
+	})
+	if listErr != nil {
+		return nil, listErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return chunks, nil
+}
+
+// GetChunk sets the MD5 of chunk from the response, so it can be verified without
+// another request.
+func (this *Backend) GetChunk(chunk *Common.RemoteChunk, writer io.Writer) (int64, error) {
+	object, info, err := this.core.GetObject(this.bucket, this.key(chunk.Id), minio.GetObjectOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer object.Close()
+
+	if chunk.MD5 == "" {
+		chunk.MD5 = fromObjectInfo(info)["OZB_md5"]
+	}
+
+	return io.Copy(writer, object)
+}
+
+func (this *Backend) ChunkMD5(chunk *Common.RemoteChunk) (string, error) {
+	properties, err := this.stat(chunk.Id)
+	if err != nil {
+		return "", err
+	}
+	return properties["OZB_md5"], nil
+}
+
+func (this *Backend) PutMetadata(meta *Common.Metadata) error {
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	_, err = this.put(Common.MetadataFileName(meta.Uuid), bytes.NewReader(metaBytes), Common.MetadataProperties(meta))
+	return err
+}
+
+func (this *Backend) GetMetadata(uuid string) (*Common.Metadata, error) {
+	marshalled, err := this.get(Common.MetadataFileName(uuid))
+	if isNotFound(err) {
+		return nil, Common.E_NO_METADATA
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	unmarshalled := &Common.Metadata{}
+	err = json.Unmarshal(marshalled, unmarshalled)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalled, nil
+}
+
+func (this *Backend) ListMetadata(fileType string, subvolume string, callback func(*Common.Metadata)) error {
+	var names []string
+	err := this.list("", func(name string, info minio.ObjectInfo) {
+		if strings.HasSuffix(name, "|M") {
+			names = append(names, name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Needs a HEAD request per snapshot, so they are sent in parallel
+	all := make([]map[string]string, len(names))
+	errs := make(chan error, len(names))
+	slots := make(chan struct{}, STAT_CONCURRENCY)
+	var wait sync.WaitGroup
+	for i, name := range names {
+		wait.Add(1)
+		slots <- struct{}{}
+		go func(i int, name string) {
+			defer wait.Done()
+			defer func() { <-slots }()
+			properties, err := this.stat(name)
+			if err != nil {
+				errs <- err
+				return
+			}
+			all[i] = properties
+		}(i, name)
+	}
+	wait.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	for _, properties := range all {
+		if properties["OZB_type"] != "metadata" {
+			continue
+		}
+		if fileType != "" && properties["OZB_filetype"] != fileType {
+			continue
+		}
+		if subvolume != "" && properties["OZB_subvolume"] != subvolume {
+			continue
+		}
+		callback(Common.MetadataFromProperties(properties))
+	}
+
+	return nil
+}
+
+func (this *Backend) GetLatest(subvolume string) (*Common.Snapshot, error) {
+	properties, err := this.stat(Common.LatestFileName(subvolume))
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Common.Snapshot{Uuid: properties["OZB_uuid"], Filename: properties["OZB_filename"]}, nil
+}
+
+func (this *Backend) SetLatest(subvolume string, latest *Common.Snapshot) error {
+	_, err := this.put(Common.LatestFileName(subvolume), strings.NewReader(latest.Filename), Common.LatestProperties(latest, subvolume))
+	this.forgetPointers()
+	return err
+}
+
+// latestPointers returns the names of the latest pointers below prefix, which is either
+// empty or QUARANTINE_PREFIX. Latest pointers are named after their subvolume, so finding
+// them needs a listing of the whole folder. It is listed only once, as cleanups need the
+// pointers for every snapshot they delete or move.
+func (this *Backend) latestPointers(prefix string) ([]string, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if pointers, ok := this.pointers[prefix]; ok {
+		return pointers, nil
+	}
+
+	pointers := []string{}
+	err := this.list(prefix, func(name string, info minio.ObjectInfo) {
+		if strings.HasSuffix(name, "|latest") {
+			pointers = append(pointers, name)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	this.pointers[prefix] = pointers
+	return pointers, nil
+}
+
+// forgetPointers makes latestPointers list the pointers again, after one was added or moved.
+func (this *Backend) forgetPointers() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.pointers = make(map[string][]string)
+}
+
+// pointersTo returns the latest pointers below prefix that point to uuid. Pointers that
+// were removed since they were listed are skipped.
+func (this *Backend) pointersTo(uuid string, prefix string) ([]string, error) {
+	pointers, err := this.latestPointers(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range pointers {
+		properties, err := this.stat(name)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if properties["OZB_uuid"] == uuid {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// ListUuids relies on object names only, so it does not need a HEAD request per object.
+func (this *Backend) ListUuids() ([]string, error) {
+	seen := make(map[string]bool)
+	var uuids []string
+	var latests []string
+
+	err := this.list("", func(name string, info minio.ObjectInfo) {
+		if strings.HasSuffix(name, "|latest") {
+			latests = append(latests, name)
+			return
+		}
+		uuid := strings.SplitN(name, "|", 2)[0]
+		if !strings.Contains(name, "|") || seen[uuid] {
+			return
+		}
+		seen[uuid] = true
+		uuids = append(uuids, uuid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Latest pointers belong to the snapshot they point to
+	for _, name := range latests {
+		properties, err := this.stat(name)
+		if err != nil {
+			return nil, err
+		}
+		uuid := properties["OZB_uuid"]
+		if uuid != "" && !seen[uuid] {
+			seen[uuid] = true
+			uuids = append(uuids, uuid)
+		}
+	}
+
+	return uuids, nil
+}
+
+// Delete only lists the objects of uuid, and the latest pointers once per backend.
+func (this *Backend) Delete(uuid string) error {
+	var names []string
+
+	err := this.list(uuid+"|", func(name string, info minio.ObjectInfo) {
+		names = append(names, name)
+	})
+	if err != nil {
+		return err
+	}
+
+	pointers, err := this.pointersTo(uuid, "")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range append(names, pointers...) {
+		err = this.core.RemoveObject(this.bucket, this.key(name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Quota reports the size of all objects below the prefix, quarantined ones included. S3 itself has no quota.
+func (this *Backend) Quota() (*Common.Quota, error) {
+	q := Common.Quota{Unlimited: true}
+
+	count := func(name string, info minio.ObjectInfo) {
+		q.Used += uint64(info.Size)
+	}
+	err := this.list("", count)
+	if err != nil {
+		return nil, err
+	}
+	err = this.list(QUARANTINE_PREFIX, count)
+	if err != nil {
+		return nil, err
+	}
+
+	return &q, nil
+}
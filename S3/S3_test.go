@@ -0,0 +1,310 @@
+package S3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"../Common"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/minio/minio-go"
+)
+
+// newTestBackend returns a backend on an in-process S3 server. Over plain HTTP minio-go
+// signs uploads in streaming mode, which the fake does not verify, so it uses TLS.
+func newTestBackend(t *testing.T) *Backend {
+	backend, _ := newCountingTestBackend(t)
+	return backend
+}
+
+// newCountingTestBackend also counts the listings of the whole folder, quarantine included.
+func newCountingTestBackend(t *testing.T) (*Backend, *int32) {
+	var folderListings int32
+	handler := gofakes3.New(s3mem.New()).Server()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("list-type") != "" && (query.Get("prefix") == "backups/tank/" || query.Get("prefix") == "backups/tank/"+QUARANTINE_PREFIX) {
+			atomic.AddInt32(&folderListings, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	minio.DefaultTransport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+
+	backend, err := NewBackend(strings.TrimPrefix(server.URL, "https://"), "key", "secret", true, "us-east-1", "bucket", "backups/tank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend, &folderListings
+}
+
+func randomData(t *testing.T, size int) ([]byte, string) {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, fmt.Sprintf("%x", md5.Sum(data))
+}
+
+func chunkInfo(uuid string, chunk uint) *Common.ChunkInfo {
+	return &Common.ChunkInfo{Uuid: uuid, FileName: "tank/data@1", Encryption: "aes-gcm", Authentication: "hmac-sha3-512", IsData: true, Chunk: chunk}
+}
+
+func TestChunks(t *testing.T) {
+	backend := newTestBackend(t)
+
+	small, smallMD5 := randomData(t, 1024)
+	// Uploaded as multipart upload
+	large, largeMD5 := randomData(t, PART_SIZE+123)
+
+	err := backend.PutChunk(chunkInfo("u", 0), bytes.NewReader(small), smallMD5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.PutChunk(chunkInfo("u", 1), bytes.NewReader(large), largeMD5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := backend.ListChunks("u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("listed %d chunks, want 2", len(chunks))
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Chunk < chunks[j].Chunk })
+
+	for i, want := range []struct {
+		data []byte
+		md5  string
+	}{{small, smallMD5}, {large, largeMD5}} {
+		chunk := chunks[i]
+		if chunk.Chunk != uint(i) || chunk.Size != int64(len(want.data)) {
+			t.Errorf("chunk %d listed as %d with %d bytes", i, chunk.Chunk, chunk.Size)
+		}
+
+		stored, err := backend.ChunkMD5(chunk)
+		if err != nil || stored != want.md5 {
+			t.Errorf("ChunkMD5 of chunk %d = %q, %v, want %q", i, stored, err, want.md5)
+		}
+
+		var got bytes.Buffer
+		_, err = backend.GetChunk(chunk, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want.data) {
+			t.Errorf("chunk %d differs", i)
+		}
+		if chunk.MD5 != want.md5 {
+			t.Errorf("GetChunk set MD5 of chunk %d to %q, want %q", i, chunk.MD5, want.md5)
+		}
+	}
+}
+
+func TestPutChunkHashMismatch(t *testing.T) {
+	backend := newTestBackend(t)
+
+	data, _ := randomData(t, 1024)
+	err := backend.PutChunk(chunkInfo("u", 0), bytes.NewReader(data), fmt.Sprintf("%x", md5.Sum(nil)))
+	if err != Common.E_BACKEND_HASH_MISMATCH {
+		t.Fatalf("PutChunk with a wrong MD5 returned %v", err)
+	}
+}
+
+// Chunks uploaded without an MD5 still get the MD5 of what was stored
+func TestPutChunkWithoutMD5(t *testing.T) {
+	backend := newTestBackend(t)
+
+	data, dataMD5 := randomData(t, 1024)
+	err := backend.PutChunk(chunkInfo("u", 0), bytes.NewReader(data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := backend.ChunkMD5(&Common.RemoteChunk{Id: Common.ChunkFileName("u", 0)})
+	if err != nil || stored != dataMD5 {
+		t.Errorf("ChunkMD5 = %q, %v, want %q", stored, err, dataMD5)
+	}
+}
+
+func TestStreamChunk(t *testing.T) {
+	backend := newTestBackend(t)
+
+	data, dataMD5 := randomData(t, PART_SIZE+1)
+	streamed, err := backend.StreamChunk(chunkInfo("u", 0), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamed != dataMD5 {
+		t.Errorf("StreamChunk returned %q, want %q", streamed, dataMD5)
+	}
+
+	stored, err := backend.ChunkMD5(&Common.RemoteChunk{Id: Common.ChunkFileName("u", 0)})
+	if err != nil || stored != dataMD5 {
+		t.Errorf("ChunkMD5 = %q, %v, want %q", stored, err, dataMD5)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	backend := newTestBackend(t)
+
+	_, err := backend.GetMetadata("missing")
+	if err != Common.E_NO_METADATA {
+		t.Fatalf("GetMetadata of a missing snapshot returned %v", err)
+	}
+
+	for i := 0; i < 2*STAT_CONCURRENCY; i++ {
+		subvolume := "tank/data"
+		if i%2 == 1 {
+			subvolume = "tank/other"
+		}
+		meta := &Common.Metadata{Uuid: fmt.Sprintf("u%d", i), FileName: fmt.Sprintf("%s@%d", subvolume, i), FileType: "zfs", Subvolume: subvolume, Chunks: 1, KeyCheck: "check"}
+		err = backend.PutMetadata(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listed := make(map[string]bool)
+	err = backend.ListMetadata("zfs", "tank/data", func(meta *Common.Metadata) {
+		listed[meta.Uuid] = true
+		if meta.Subvolume != "tank/data" {
+			t.Errorf("listed %s of %s", meta.Uuid, meta.Subvolume)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != STAT_CONCURRENCY {
+		t.Errorf("listed %d snapshots, want %d", len(listed), STAT_CONCURRENCY)
+	}
+
+	meta, err := backend.GetMetadata("u3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.FileName != "tank/other@3" || meta.KeyCheck != "check" {
+		t.Errorf("GetMetadata returned %+v", meta)
+	}
+}
+
+func TestLatestAndDelete(t *testing.T) {
+	backend := newTestBackend(t)
+
+	latest, err := backend.GetLatest("tank/data")
+	if err != nil || latest != nil {
+		t.Fatalf("GetLatest without snapshots returned %v, %v", latest, err)
+	}
+
+	for _, uuid := range []string{"u1", "u2"} {
+		data, dataMD5 := randomData(t, 10)
+		err = backend.PutChunk(chunkInfo(uuid, 0), bytes.NewReader(data), dataMD5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = backend.PutMetadata(&Common.Metadata{Uuid: uuid, FileName: "tank/data@" + uuid, Subvolume: "tank/data"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = backend.SetLatest("tank/data", &Common.Snapshot{Uuid: "u1", Filename: "tank/data@u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err = backend.GetLatest("tank/data")
+	if err != nil || latest == nil || latest.Uuid != "u1" {
+		t.Fatalf("GetLatest returned %v, %v", latest, err)
+	}
+
+	err = backend.Delete("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uuids, err := backend.ListUuids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uuids) != 1 || uuids[0] != "u2" {
+		t.Errorf("ListUuids after Delete returned %v", uuids)
+	}
+	latest, err = backend.GetLatest("tank/data")
+	if err != nil || latest != nil {
+		t.Errorf("the latest pointer of a deleted snapshot is still there: %v, %v", latest, err)
+	}
+}
+
+// A cleanup lists the whole folder once for the latest pointers, not once per snapshot
+func TestCleanupListings(t *testing.T) {
+	backend, folderListings := newCountingTestBackend(t)
+
+	for _, uuid := range []string{"u1", "u2", "u3", "u4"} {
+		data, dataMD5 := randomData(t, 10)
+		err := backend.PutChunk(chunkInfo(uuid, 0), bytes.NewReader(data), dataMD5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = backend.PutMetadata(&Common.Metadata{Uuid: uuid, FileName: "tank/data@" + uuid, Subvolume: "tank/data"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for subvolume, uuid := range map[string]string{"tank/data": "u4", "tank/old": "u1", "tank/quarantined": "u2"} {
+		err := backend.SetLatest(subvolume, &Common.Snapshot{Uuid: uuid, Filename: subvolume + "@" + uuid})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	atomic.StoreInt32(folderListings, 0)
+	for _, uuid := range []string{"u1", "u3"} {
+		err := backend.Delete(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if listings := atomic.LoadInt32(folderListings); listings != 1 {
+		t.Errorf("deleting two snapshots listed the folder %d times", listings)
+	}
+
+	err := backend.Quarantine("u2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(folderListings, 0)
+	err = backend.Purge("u2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listings := atomic.LoadInt32(folderListings); listings != 1 {
+		t.Errorf("purging a snapshot listed the folder %d times", listings)
+	}
+
+	uuids, err := backend.ListUuids()
+	if err != nil || len(uuids) != 1 || uuids[0] != "u4" {
+		t.Errorf("ListUuids after the cleanup returned %v, %v", uuids, err)
+	}
+	quarantined, err := backend.ListQuarantined()
+	if err != nil || len(quarantined) != 0 {
+		t.Errorf("ListQuarantined after purging returned %v, %v", quarantined, err)
+	}
+	for subvolume, want := range map[string]string{"tank/data": "u4", "tank/old": "", "tank/quarantined": ""} {
+		latest, err := backend.GetLatest(subvolume)
+		if err != nil || (latest == nil) != (want == "") || (latest != nil && latest.Uuid != want) {
+			t.Errorf("latest pointer of %s is %+v, %v, want %q", subvolume, latest, err, want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package SFTP
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"../Common"
+	"../Local"
+	"github.com/pkg/sftp"
+	"github.com/prometheus/common/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var E_NO_AUTH = errors.New("no private key or ssh-agent available to authenticate with")
+
+// Filesystem is a Local.Filesystem on a remote host.
+// A lost connection is re-established on the next call, so a retried chunk upload
+// does not fail forever after the connection dropped once.
+type Filesystem struct {
+	address string
+	config  *ssh.ClientConfig
+	lock    sync.Mutex
+	ssh     *ssh.Client
+	sftp    *sftp.Client
+}
+
+// NewBackend stores snapshots in dir on address (host:port).
+// The host key has to be listed in knownHostsFile.
+func NewBackend(address string, user string, keyFile string, knownHostsFile string, dir string) (*Local.Backend, error) {
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth []ssh.AuthMethod
+	if keyFile != "" {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			log.Errorf("Could not connect to ssh-agent: %v", err)
+		} else {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	if len(auth) == 0 {
+		return nil, E_NO_AUTH
+	}
+
+	fs := &Filesystem{
+		address: address,
+		config:  &ssh.ClientConfig{User: user, Auth: auth, HostKeyCallback: hostKeyCallback},
+	}
+
+	return Local.NewFilesystemBackend(fs, dir, false)
+}
+
+func (this *Filesystem) client() (*sftp.Client, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.sftp != nil {
+		return this.sftp, nil
+	}
+
+	log.Infof("Connecting to %s...", this.address)
+	sshClient, err := ssh.Dial("tcp", this.address, this.config)
+	if err != nil {
+		return nil, err
+	}
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+
+	this.ssh = sshClient
+	this.sftp = sftpClient
+	return this.sftp, nil
+}
+
+// check drops the connection if err indicates that it is gone.
+func (this *Filesystem) check(err error) error {
+	if err != sftp.ErrSSHFxConnectionLost && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	log.Warnf("Lost connection to %s", this.address)
+	if this.sftp != nil {
+		this.sftp.Close()
+		this.ssh.Close()
+		this.sftp = nil
+		this.ssh = nil
+	}
+	return err
+}
+
+// file hides the Sync of sftp.File, as not every server supports fsync@openssh.com.
+type file struct {
+	fs   *Filesystem
+	file *sftp.File
+}
+
+func (this *file) Read(p []byte) (int, error) {
+	n, err := this.file.Read(p)
+	return n, this.fs.check(err)
+}
+
+func (this *file) Write(p []byte) (int, error) {
+	n, err := this.file.Write(p)
+	return n, this.fs.check(err)
+}
+
+func (this *file) Close() error {
+	return this.fs.check(this.file.Close())
+}
+
+func (this *Filesystem) Create(name string) (io.WriteCloser, error) {
+	client, err := this.client()
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Create(name)
+	if err != nil {
+		return nil, this.check(err)
+	}
+	return &file{fs: this, file: f}, nil
+}
+
+func (this *Filesystem) Open(name string) (io.ReadCloser, error) {
+	client, err := this.client()
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(name)
+	if err != nil {
+		return nil, this.check(err)
+	}
+	return &file{fs: this, file: f}, nil
+}
+
+func (this *Filesystem) Rename(oldname string, newname string) error {
+	client, err := this.client()
+	if err != nil {
+		return err
+	}
+	// Plain SFTP renames fail if newname exists
+	return this.check(client.PosixRename(oldname, newname))
+}
+
+func (this *Filesystem) Remove(name string) error {
+	client, err := this.client()
+	if err != nil {
+		return err
+	}
+	return this.check(client.Remove(name))
+}
+
+func (this *Filesystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	client, err := this.client()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := client.ReadDir(dirname)
+	return entries, this.check(err)
+}
+
+func (this *Filesystem) MkdirAll(dirname string) error {
+	client, err := this.client()
+	if err != nil {
+		return err
+	}
+	return this.check(client.MkdirAll(dirname))
+}
+
+func (this *Filesystem) Quota(dirname string) (*Common.Quota, error) {
+	client, err := this.client()
+	if err != nil {
+		return nil, err
+	}
+	stat, err := client.StatVFS(dirname)
+	if err != nil {
+		return nil, this.check(err)
+	}
+
+	return &Common.Quota{
+		Limit: stat.TotalSpace(),
+		Used:  stat.TotalSpace() - stat.FreeSpace(),
+	}, nil
+}
@@ -0,0 +1,293 @@
+package SFTP
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"../Common"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testServer is an in-process SSH server with the SFTP subsystem on the local filesystem.
+type testServer struct {
+	listener  net.Listener
+	config    *ssh.ServerConfig
+	hostKey   ssh.Signer
+	dir       string
+	keyFile   string
+	knownHost string
+	lock      sync.Mutex
+	conns     []net.Conn
+}
+
+func newTestServer(t *testing.T) *testServer {
+	dir, err := ioutil.TempDir("", "ozbsftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPublic, userKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userSSHKey, err := ssh.NewPublicKey(userPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if bytes.Equal(key.Marshal(), userSSHKey.Marshal()) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unknown key for %s", meta.User())
+	}}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &testServer{listener: listener, config: config, hostKey: hostSigner, dir: dir}
+
+	block, err := ssh.MarshalPrivateKey(userKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.keyFile = filepath.Join(dir, "id_ed25519")
+	err = ioutil.WriteFile(server.keyFile, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.knownHost = filepath.Join(dir, "known_hosts")
+	server.writeKnownHost(t, hostSigner.PublicKey())
+
+	// Only the key file may be used to authenticate
+	socket, hadSocket := os.LookupEnv("SSH_AUTH_SOCK")
+	os.Unsetenv("SSH_AUTH_SOCK")
+	t.Cleanup(func() {
+		if hadSocket {
+			os.Setenv("SSH_AUTH_SOCK", socket)
+		}
+	})
+
+	go server.serve()
+	return server
+}
+
+func (this *testServer) writeKnownHost(t *testing.T, key ssh.PublicKey) {
+	line := knownhosts.Line([]string{this.listener.Addr().String()}, key)
+	err := ioutil.WriteFile(this.knownHost, []byte(line+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (this *testServer) serve() {
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			return
+		}
+		this.lock.Lock()
+		this.conns = append(this.conns, conn)
+		this.lock.Unlock()
+
+		go func() {
+			_, channels, requests, err := ssh.NewServerConn(conn, this.config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			for newChannel := range channels {
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go func() {
+					for request := range requests {
+						subsystem := request.Type == "subsystem" && string(request.Payload[4:]) == "sftp"
+						request.Reply(subsystem, nil)
+						if subsystem {
+							server, err := sftp.NewServer(channel)
+							if err != nil {
+								channel.Close()
+								return
+							}
+							go server.Serve()
+						}
+					}
+				}()
+			}
+		}()
+	}
+}
+
+// dropConnections closes every connection, as if the network went away.
+func (this *testServer) dropConnections() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, conn := range this.conns {
+		conn.Close()
+	}
+	this.conns = nil
+}
+
+func putChunk(t *testing.T, backend Common.Backend, uuid string, chunk uint, data []byte) {
+	info := &Common.ChunkInfo{Uuid: uuid, FileName: "tank/data@1", Encryption: "aes-gcm", Authentication: "hmac-sha3-512", IsData: true, Chunk: chunk}
+	err := backend.PutChunk(info, bytes.NewReader(data), fmt.Sprintf("%x", md5.Sum(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	server := newTestServer(t)
+	backend, err := NewBackend(server.listener.Addr().String(), "backup", server.keyFile, server.knownHost, filepath.Join(server.dir, "remote/backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 3*1024*1024+5)
+	rand.Read(data)
+	putChunk(t, backend, "u1", 0, data)
+	putChunk(t, backend, "u1", 1, data[:10])
+
+	chunks, err := backend.ListChunks("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("listed %d chunks, want 2", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if chunk.Chunk != 0 {
+			continue
+		}
+		var got bytes.Buffer
+		_, err = backend.GetChunk(chunk, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), data) || chunk.MD5 != fmt.Sprintf("%x", md5.Sum(data)) {
+			t.Errorf("chunk 0 differs")
+		}
+	}
+
+	err = backend.PutMetadata(&Common.Metadata{Uuid: "u1", FileName: "tank/data@1", Subvolume: "tank/data", Chunks: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := backend.GetMetadata("u1")
+	if err != nil || meta.Chunks != 2 {
+		t.Fatalf("GetMetadata returned %+v, %v", meta, err)
+	}
+
+	// The second pointer replaces the first one
+	for _, uuid := range []string{"u0", "u1"} {
+		err = backend.SetLatest("tank/data", &Common.Snapshot{Uuid: uuid, Filename: "tank/data@" + uuid})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	latest, err := backend.GetLatest("tank/data")
+	if err != nil || latest == nil || latest.Uuid != "u1" {
+		t.Fatalf("GetLatest returned %v, %v", latest, err)
+	}
+
+	quota, err := backend.Quota()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.Limit == 0 || quota.Used > quota.Limit {
+		t.Errorf("Quota returned %+v", quota)
+	}
+
+	err = backend.Delete("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuids, err := backend.ListUuids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uuids) != 0 {
+		t.Errorf("ListUuids after Delete returned %v", uuids)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	server := newTestServer(t)
+	backend, err := NewBackend(server.listener.Addr().String(), "backup", server.keyFile, server.knownHost, filepath.Join(server.dir, "backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	putChunk(t, backend, "u1", 0, []byte("chunk"))
+
+	server.dropConnections()
+
+	// The call that notices the lost connection fails, the next one connects again
+	for attempt := 0; ; attempt++ {
+		_, err = backend.ListChunks("u1")
+		if err == nil {
+			break
+		}
+		if attempt == 1 {
+			t.Fatalf("no new connection after it was lost: %v", err)
+		}
+	}
+}
+
+func TestUnknownHostKey(t *testing.T) {
+	server := newTestServer(t)
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSigner, err := ssh.NewSignerFromKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.writeKnownHost(t, otherSigner.PublicKey())
+
+	backend, err := NewBackend(server.listener.Addr().String(), "backup", server.keyFile, server.knownHost, filepath.Join(server.dir, "backups"))
+	if err == nil {
+		_, err = backend.ListUuids()
+	}
+	if err == nil {
+		t.Fatal("connected to a host with an unknown key")
+	}
+}
+
+func TestNoAuth(t *testing.T) {
+	server := newTestServer(t)
+
+	_, err := NewBackend(server.listener.Addr().String(), "backup", "", server.knownHost, filepath.Join(server.dir, "backups"))
+	if err != E_NO_AUTH {
+		t.Fatalf("NewBackend without a key returned %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package WebDAV
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"../Common"
+	"../Local"
+	"github.com/studio-b12/gowebdav"
+)
+
+var E_NO_QUOTA = errors.New("server does not report a quota")
+
+// Filesystem is a Local.Filesystem on a WebDAV share, e.g. Nextcloud or ownCloud.
+// The OZB properties are kept in the sidecar files of Local.Backend rather than as dead
+// properties, as not every server keeps those across a MOVE.
+type Filesystem struct {
+	url      string
+	user     string
+	password string
+	client   *gowebdav.Client
+}
+
+// NewBackend stores snapshots in dir on the share at url.
+// For Nextcloud the url looks like https://cloud.example.com/remote.php/dav/files/<user>/
+func NewBackend(url string, user string, password string, dir string) (*Local.Backend, error) {
+	fs := &Filesystem{
+		url:      strings.TrimSuffix(url, "/"),
+		user:     user,
+		password: password,
+		client:   gowebdav.NewAuthClient(url, gowebdav.NewPreemptiveAuth(&basicAuth{user: user, password: password})),
+	}
+
+	return Local.NewFilesystemBackend(fs, dir, false)
+}
+
+// basicAuth always sends the credentials. The negotiating authenticator of gowebdav
+// buffers every request body to be able to replay it, which would keep a whole chunk in memory.
+type basicAuth struct {
+	user     string
+	password string
+}
+
+func (this *basicAuth) Authorize(c *http.Client, rq *http.Request, path string) error {
+	rq.SetBasicAuth(this.user, this.password)
+	return nil
+}
+
+func (this *basicAuth) Verify(c *http.Client, rs *http.Response, path string) (bool, error) {
+	if rs.StatusCode == http.StatusUnauthorized {
+		return false, gowebdav.NewPathError("Authorize", path, rs.StatusCode)
+	}
+	return false, nil
+}
+
+func (this *basicAuth) Close() error {
+	return nil
+}
+
+func (this *basicAuth) Clone() gowebdav.Authenticator {
+	return this
+}
+
+func (this *basicAuth) String() string {
+	return "BasicAuth login: " + this.user
+}
+
+// notExist maps a 404 to os.ErrNotExist, which is what Local.Backend checks for.
+func notExist(err error) error {
+	if gowebdav.IsErrNotFound(err) {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+// upload streams everything written to it into a single PUT.
+type upload struct {
+	writer *io.PipeWriter
+	done   chan error
+}
+
+func (this *upload) Write(p []byte) (int, error) {
+	return this.writer.Write(p)
+}
+
+func (this *upload) Close() error {
+	this.writer.Close()
+	return <-this.done
+}
+
+func (this *Filesystem) ClassifyError(err error) *Common.ErrorClass {
+	var statusErr gowebdav.StatusError
+	if !errors.As(err, &statusErr) {
+		return nil
+	}
+
+	switch {
+	case statusErr.Status == http.StatusTooManyRequests || statusErr.Status == http.StatusServiceUnavailable:
+		return &Common.ErrorClass{Wait: 30 * time.Second}
+	case statusErr.Status >= 500 && statusErr.Status != http.StatusInsufficientStorage:
+		return &Common.ErrorClass{}
+	default:
+		// Wrong credentials, missing permissions or a full share
+		return &Common.ErrorClass{Permanent: true}
+	}
+}
+
+func (this *Filesystem) Create(name string) (io.WriteCloser, error) {
+	reader, writer := io.Pipe()
+	stream := &upload{writer: writer, done: make(chan error, 1)}
+
+	go func() {
+		err := this.client.WriteStream(name, reader, 0600)
+		// Unblocks the writer if the request failed before reading everything
+		reader.CloseWithError(err)
+		stream.done <- err
+	}()
+
+	return stream, nil
+}
+
+func (this *Filesystem) Open(name string) (io.ReadCloser, error) {
+	stream, err := this.client.ReadStream(name)
+	return stream, notExist(err)
+}
+
+func (this *Filesystem) Rename(oldname string, newname string) error {
+	return notExist(this.client.Rename(oldname, newname, true))
+}
+
+func (this *Filesystem) Remove(name string) error {
+	return notExist(this.client.Remove(name))
+}
+
+func (this *Filesystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	entries, err := this.client.ReadDir(dirname)
+	return entries, notExist(err)
+}
+
+func (this *Filesystem) MkdirAll(dirname string) error {
+	return this.client.MkdirAll(dirname, 0700)
+}
+
+// quotaResponse is the part of a PROPFIND multistatus carrying the RFC 4331 quota properties.
+type quotaResponse struct {
+	Available string `xml:"response>propstat>prop>quota-available-bytes"`
+	Used      string `xml:"response>propstat>prop>quota-used-bytes"`
+}
+
+const quotaRequest = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:quota-available-bytes/><d:quota-used-bytes/></d:prop></d:propfind>`
+
+func (this *Filesystem) Quota(dirname string) (*Common.Quota, error) {
+	request, err := http.NewRequest("PROPFIND", this.url+"/"+strings.TrimPrefix(gowebdav.PathEscape(dirname), "/"), strings.NewReader(quotaRequest))
+	if err != nil {
+		return nil, err
+	}
+	request.SetBasicAuth(this.user, this.password)
+	request.Header.Set("Depth", "0")
+	request.Header.Set("Content-Type", "application/xml;charset=UTF-8")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("PROPFIND %s: %s", dirname, response.Status)
+	}
+
+	parsed := &quotaResponse{}
+	err = xml.NewDecoder(response.Body).Decode(parsed)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Used == "" {
+		return nil, E_NO_QUOTA
+	}
+
+	used, err := strconv.ParseUint(parsed.Used, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	// Negative values mean that there is no limit, e.g. -3 on Nextcloud
+	available, err := strconv.ParseUint(parsed.Available, 10, 64)
+	if err != nil {
+		return &Common.Quota{Used: used, Unlimited: true}, nil
+	}
+
+	return &Common.Quota{Limit: used + available, Used: used}, nil
+}
@@ -0,0 +1,196 @@
+package WebDAV
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"../Common"
+	"github.com/studio-b12/gowebdav"
+	"golang.org/x/net/webdav"
+)
+
+// newTestServer returns an in-process WebDAV share that asks for user:password.
+// PROPFINDs for the quota properties are answered with quota, if it is set.
+func newTestServer(t *testing.T, quota string) *httptest.Server {
+	dir, err := ioutil.TempDir("", "ozbdav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	handler := &webdav.Handler{FileSystem: webdav.Dir(dir), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "user" || password != "password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method == "PROPFIND" && quota != "" {
+			body, _ := ioutil.ReadAll(r.Body)
+			if strings.Contains(string(body), "quota-used-bytes") {
+				w.WriteHeader(http.StatusMultiStatus)
+				fmt.Fprintf(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"><d:response><d:href>/</d:href><d:propstat><d:prop>%s</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`, quota)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func putChunk(backend Common.Backend, uuid string, chunk uint, data []byte) error {
+	info := &Common.ChunkInfo{Uuid: uuid, FileName: "tank/data@1", Encryption: "aes-gcm", Authentication: "hmac-sha3-512", IsData: true, Chunk: chunk}
+	return backend.PutChunk(info, bytes.NewReader(data), fmt.Sprintf("%x", md5.Sum(data)))
+}
+
+func TestBackend(t *testing.T) {
+	server := newTestServer(t, "")
+	backend, err := NewBackend(server.URL+"/", "user", "password", "backups/tank")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 3*1024*1024+5)
+	rand.Read(data)
+	for chunk, content := range [][]byte{data, data[:10]} {
+		err = putChunk(backend, "u1", uint(chunk), content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chunks, err := backend.ListChunks("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("listed %d chunks, want 2", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if chunk.Chunk != 0 {
+			continue
+		}
+		var got bytes.Buffer
+		_, err = backend.GetChunk(chunk, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), data) || chunk.MD5 != fmt.Sprintf("%x", md5.Sum(data)) {
+			t.Errorf("chunk 0 differs")
+		}
+	}
+
+	err = backend.PutMetadata(&Common.Metadata{Uuid: "u1", FileName: "tank/data@1", Subvolume: "tank/data", Chunks: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := backend.GetMetadata("u1")
+	if err != nil || meta.Chunks != 2 {
+		t.Fatalf("GetMetadata returned %+v, %v", meta, err)
+	}
+	_, err = backend.GetMetadata("missing")
+	if err != Common.E_NO_METADATA {
+		t.Errorf("GetMetadata of a missing snapshot returned %v", err)
+	}
+
+	// The second pointer replaces the first one
+	for _, uuid := range []string{"u0", "u1"} {
+		err = backend.SetLatest("tank/data", &Common.Snapshot{Uuid: uuid, Filename: "tank/data@" + uuid})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	latest, err := backend.GetLatest("tank/data")
+	if err != nil || latest == nil || latest.Uuid != "u1" {
+		t.Fatalf("GetLatest returned %v, %v", latest, err)
+	}
+
+	err = backend.Delete("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuids, err := backend.ListUuids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uuids) != 0 {
+		t.Errorf("ListUuids after Delete returned %v", uuids)
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	server := newTestServer(t, "")
+
+	// Creating the directory is the first request
+	_, err := NewBackend(server.URL+"/", "user", "wrong", "backups/tank")
+	if err == nil {
+		t.Fatal("connected with a wrong password")
+	}
+	class := (&Filesystem{}).ClassifyError(err)
+	if class == nil || !class.Permanent {
+		t.Errorf("a rejected password is classified as %+v", class)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	for _, test := range []struct {
+		properties string
+		quota      *Common.Quota
+		err        error
+	}{
+		{"<d:quota-available-bytes>300</d:quota-available-bytes><d:quota-used-bytes>100</d:quota-used-bytes>", &Common.Quota{Limit: 400, Used: 100}, nil},
+		{"<d:quota-available-bytes>-3</d:quota-available-bytes><d:quota-used-bytes>100</d:quota-used-bytes>", &Common.Quota{Used: 100, Unlimited: true}, nil},
+		{"", nil, E_NO_QUOTA},
+	} {
+		// Without properties the PROPFIND is left to x/net/webdav, which does not know them
+		server := newTestServer(t, test.properties)
+		backend, err := NewBackend(server.URL+"/", "user", "password", "backups/tank")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := backend.Quota()
+		if err != test.err {
+			t.Errorf("Quota with %q returned %v, want %v", test.properties, err, test.err)
+			continue
+		}
+		if test.quota != nil && *got != *test.quota {
+			t.Errorf("Quota with %q returned %+v, want %+v", test.properties, got, test.quota)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	fs := &Filesystem{}
+	for _, test := range []struct {
+		status    int
+		permanent bool
+		wait      bool
+	}{
+		{http.StatusServiceUnavailable, false, true},
+		{http.StatusTooManyRequests, false, true},
+		{http.StatusBadGateway, false, false},
+		{http.StatusInsufficientStorage, true, false},
+		{http.StatusForbidden, true, false},
+	} {
+		class := fs.ClassifyError(gowebdav.StatusError{Status: test.status})
+		if class == nil || class.Permanent != test.permanent || (class.Wait != 0) != test.wait {
+			t.Errorf("status %d is classified as %+v", test.status, class)
+		}
+	}
+
+	if fs.ClassifyError(os.ErrNotExist) != nil {
+		t.Errorf("errors without a status are classified")
+	}
+}
@@ -7,11 +7,11 @@ import (
 	"github.com/prometheus/common/log"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 
 	"../Common"
-	"../GoogleDrive"
 )
 
 type Manager struct {
@@ -21,7 +21,7 @@ type Manager struct {
 
 func NewManager(folder string) *Manager {
 	this := &Manager{}
-	this.parent = GoogleDrive.FindOrCreateFolder(folder)
+	this.parent = folder
 	return this
 }
 
@@ -155,6 +155,58 @@ func (this *Manager) Stream(snapshot string, parentSnapshot string) (io.ReadClos
 	return rc, nil
 }
 
+// getProperty returns the parsable value of a property of dataset.
+func getProperty(dataset string, property string) (string, error) {
+	cmd := exec.Command("zfs", "get", "-Hp", "-o", "value", property, dataset)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
+
+// EstimateSize works without a snapshot, unlike `zfs send -nvP`.
+// A full stream is about the logical size of the dataset. An incremental one is about
+// what was written since the parent, which is counted compressed and has to be scaled up.
+func (this *Manager) EstimateSize(subvolume string, parentSnapshot string) (uint64, error) {
+	if parentSnapshot == "" {
+		logical, err := getProperty(subvolume, "logicalreferenced")
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseUint(logical, 10, 64)
+	}
+
+	parts := strings.SplitN(parentSnapshot, "@", 2)
+	if len(parts) != 2 {
+		return 0, Common.E_INVALID_SNAPSHOT
+	}
+	written, err := getProperty(subvolume, "written@"+parts[1])
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseUint(written, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	ratio, err := getProperty(subvolume, "refcompressratio")
+	if err != nil {
+		return 0, err
+	}
+	factor, err := strconv.ParseFloat(strings.TrimSuffix(ratio, "x"), 64)
+	if err != nil || factor < 1 {
+		factor = 1
+	}
+
+	return uint64(float64(size) * factor), nil
+}
+
 func (this *Manager) Restore(targetSubvolume string) (io.WriteCloser, error) {
 	command := exec.Command("zfs", "receive", "-F", targetSubvolume)
 
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"./Abstractions"
+	"./Common"
+	"./GoogleDrive"
+	"./Local"
+	"./S3"
+	"./SFTP"
+	"./WebDAV"
+	"github.com/dustin/go-humanize"
+	"github.com/hashicorp/vault/api"
+	"github.com/prometheus/common/log"
+)
+
+var driveInitialized = false
+
+// Set while opening backends with the admin credentials of --appendonly
+var useAdminCredentials = false
+
+// openBackend opens the backend(s) given by --backend.
+// Multiple comma separated backends are mirrored. Each may have its own folder
+// after a colon, e.g. `googledrive,local:/mnt/nas/backups`.
+func openBackend() Common.Backend {
+	var targets []*Abstractions.MirrorTarget
+	for _, name := range strings.Split(*backendName, ",") {
+		targets = append(targets, &Abstractions.MirrorTarget{Name: name, Backend: openBackendSpec(name)})
+	}
+
+	if len(targets) == 1 {
+		return targets[0].Backend
+	}
+	return Abstractions.NewMirror(targets)
+}
+
+// splitBackendSpec splits a backend given as `<backend>[:<folder>]`.
+// Without a folder, --folder is used.
+func splitBackendSpec(spec string) (string, string) {
+	if i := strings.Index(spec, ":"); i >= 0 {
+		return spec[:i], spec[i+1:]
+	}
+	return spec, *folder
+}
+
+// hasFolders tells whether every backend of --backend has a folder, either its own or --folder.
+func hasFolders() bool {
+	for _, spec := range strings.Split(*backendName, ",") {
+		_, backendFolder := splitBackendSpec(spec)
+		if backendFolder == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// openBackendSpec opens a backend given as `<backend>[:<folder>]`.
+func openBackendSpec(spec string) Common.Backend {
+	backend := openNamedBackend(splitBackendSpec(spec))
+
+	if *hideMetadata {
+		if *passphrase == "" {
+			log.Fatalln("--hidemetadata needs --passphrase")
+		}
+		hidden, err := Abstractions.NewHiddenMetadata(backend, *passphrase)
+		Common.PrintAndExitOnError(err, 1)
+		backend = hidden
+	}
+
+	if *appendOnly && !useAdminCredentials {
+		return Abstractions.NewAppendOnly(backend)
+	}
+	return backend
+}
+
+// hasAdminCredentials tells whether any admin credentials of --appendonly were given.
+func hasAdminCredentials() bool {
+	return *adminAccount != "" || os.Getenv("AWS_ADMIN_ACCESS_KEY_ID") != "" || *sftpAdminUser != "" || *webdavAdmin != ""
+}
+
+// adminBackend returns a backend that may delete and move files. With --appendonly
+// the backends are opened again with their admin credentials.
+func adminBackend(backend Common.Backend) (Common.Backend, error) {
+	if !*appendOnly {
+		return backend, nil
+	}
+	if !hasAdminCredentials() {
+		return nil, Common.E_APPEND_ONLY
+	}
+
+	log.Infof("Opening backend with admin credentials...")
+	useAdminCredentials = true
+	driveInitialized = false
+	return openBackend(), nil
+}
+
+func openNamedBackend(name string, folder string) Common.Backend {
+	switch strings.ToLower(name) {
+	case "googledrive":
+		if !driveInitialized {
+			if useAdminCredentials {
+				if *adminAccount == "" {
+					log.Fatalln("Must specify --adminserviceaccount to delete from googledrive with --appendonly")
+				}
+				err := GoogleDrive.UseAdminServiceAccount(*adminAccount, *impersonate)
+				Common.PrintAndExitOnError(err, 1)
+			} else {
+				initGoogleDrive()
+			}
+			if *sharedDrive != "" {
+				GoogleDrive.SetSharedDrive(*sharedDrive)
+			}
+			driveInitialized = true
+		}
+		return GoogleDrive.NewBackend(folder)
+	case "local":
+		if folder == "" {
+			log.Fatalf("Must specify --folder or %s:<folder>", name)
+		}
+		if useAdminCredentials {
+			log.Fatalf("%s has no admin credentials. Clean it up without --appendonly on a host that may delete from it", name)
+		}
+		backend, err := Local.NewBackend(folder)
+		Common.PrintAndExitOnError(err, 1)
+		return backend
+	case "s3":
+		if *s3Bucket == "" {
+			log.Fatalln("Must specify --s3bucket")
+		}
+		accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if useAdminCredentials {
+			accessKey, secretKey = os.Getenv("AWS_ADMIN_ACCESS_KEY_ID"), os.Getenv("AWS_ADMIN_SECRET_ACCESS_KEY")
+			if accessKey == "" {
+				log.Fatalln("Must set 'AWS_ADMIN_ACCESS_KEY_ID' and 'AWS_ADMIN_SECRET_ACCESS_KEY' to delete from s3 with --appendonly")
+			}
+		}
+		backend, err := S3.NewBackend(*s3Endpoint, accessKey, secretKey, !*s3Insecure, *s3Region, *s3Bucket, folder)
+		Common.PrintAndExitOnError(err, 1)
+		return backend
+	case "sftp":
+		if *sftpHost == "" {
+			log.Fatalln("Must specify --sftphost")
+		}
+		if folder == "" {
+			log.Fatalf("Must specify --folder or %s:<folder>", name)
+		}
+		username, keyFile := *sftpUser, *sftpKey
+		if useAdminCredentials {
+			if *sftpAdminUser == "" {
+				log.Fatalln("Must specify --sftpadminuser to delete from sftp with --appendonly")
+			}
+			username, keyFile = *sftpAdminUser, *sftpAdminKey
+		}
+		backend, err := openSFTP(folder, username, keyFile)
+		Common.PrintAndExitOnError(err, 1)
+		return backend
+	case "webdav":
+		if *webdavURL == "" {
+			log.Fatalln("Must specify --webdavurl")
+		}
+		if folder == "" {
+			log.Fatalf("Must specify --folder or %s:<folder>", name)
+		}
+		username, password := *webdavUser, os.Getenv("WEBDAV_PASSWORD")
+		if useAdminCredentials {
+			if *webdavAdmin == "" {
+				log.Fatalln("Must specify --webdavadminuser to delete from webdav with --appendonly")
+			}
+			username, password = *webdavAdmin, os.Getenv("WEBDAV_ADMIN_PASSWORD")
+		}
+		backend, err := WebDAV.NewBackend(*webdavURL, username, password, folder)
+		Common.PrintAndExitOnError(err, 1)
+		return backend
+	default:
+		log.Fatalf("--backend only supports googledrive, local, s3, sftp and webdav, not %s.", name)
+	}
+	return nil
+}
+
+func openSFTP(folder string, username string, keyFile string) (Common.Backend, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	address := *sftpHost
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+	if username == "" {
+		username = usr.Username
+	}
+	knownHosts := *sftpKnownHosts
+	if knownHosts == "" {
+		knownHosts = filepath.Join(usr.HomeDir, ".ssh", "known_hosts")
+	}
+
+	return SFTP.NewBackend(address, username, keyFile, knownHosts, folder)
+}
+
+func initGoogleDrive() {
+	if *vaultToken != "" {
+		log.Infoln("Using vault to access secrets...")
+		vaultConfig := api.Config{Address: *vault}
+		vaultClient, err := api.NewClient(&vaultConfig)
+		if err != nil {
+			log.Errorln(err)
+			// Try a regular Google Drive init as a fail-safe
+			GoogleDrive.InitGoogleDrive(nil, *serviceAccount, *impersonate)
+			return
+		}
+		vaultClient.SetToken(*vaultToken)
+
+		GoogleDrive.InitGoogleDrive(vaultClient, *serviceAccount, *impersonate)
+	} else {
+		GoogleDrive.InitGoogleDrive(nil, *serviceAccount, *impersonate)
+	}
+}
+
+func displayQuota(backend Common.Backend) {
+	q, err := backend.Quota()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var limit string
+	if q.Unlimited {
+		limit = "unlimited"
+	} else {
+		limit = humanize.IBytes(q.Limit)
+	}
+	log.Infof("Limit: %s, Used: %s", limit, humanize.IBytes(q.Used))
+}
+
+func listFiles(backend Common.Backend) {
+	err := backend.ListMetadata("", "", func(meta *Common.Metadata) {
+		fmt.Fprintf(
+			os.Stderr,
+			"'%s'\n\t- Date: %s\n\t- UUID: %s\n\t- Enc.: %s\n\t- Auth: %s\n\t- Size: %d chunks, %s\n",
+			meta.FileName,
+			time.Unix(meta.Date, 0).UTC().String(),
+			meta.Uuid,
+			strings.ToUpper(meta.Encryption),
+			strings.ToUpper(meta.Authentication),
+			meta.Chunks,
+			humanize.IBytes(meta.TotalSize),
+		)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -4,14 +4,12 @@ import (
 	"./Abstractions"
 	"./Btrfs"
 	"./Common"
-	"./GoogleDrive"
 	"./ZFS"
 	"github.com/prometheus/common/log"
 	"strings"
-	"google.golang.org/api/drive/v3"
 )
 
-func backupCommand() {
+func backupCommand(backend Common.Backend) {
 	if *subvolume == "" {
 		log.Fatalln("Must specify --subvolume")
 	}
@@ -31,23 +29,23 @@ func backupCommand() {
 		log.Fatalln("--backup only supports btrfs and zfs.")
 	}
 
-	folderId := GoogleDrive.FindOrCreateFolder(*folder)
-
-	var latestUploaded *drive.File
+	var latestUploaded *Common.Snapshot
 	var err error
 	if !*full {
-		latestUploaded, err = GoogleDrive.FindLatest(folderId, *subvolume)
-		log.Error(err)
+		latestUploaded, err = backend.GetLatest(*subvolume)
+		if err != nil {
+			log.Error(err)
+		}
 	}
 
 	var parentSnapshotUuid string
 	var parentSnapshotName string
 	if latestUploaded != nil {
-		if !manager.IsAvailableLocally(latestUploaded.Properties["OZB_filename"]) {
-			log.Fatalf("Latest uploaded snapshot '%s' is not available locally! Backup with --full to create a new full backup.", latestUploaded.Properties["OZB_filename"])
+		if !manager.IsAvailableLocally(latestUploaded.Filename) {
+			log.Fatalf("Latest uploaded snapshot '%s' is not available locally! Backup with --full to create a new full backup.", latestUploaded.Filename)
 		}
-		parentSnapshotUuid = latestUploaded.Properties["OZB_uuid"]
-		parentSnapshotName = latestUploaded.Properties["OZB_filename"]
+		parentSnapshotUuid = latestUploaded.Uuid
+		parentSnapshotName = latestUploaded.Filename
 	} else {
 		log.Infof("Doing full backup, as no uploaded snapshot was found or --full was specified.")
 	}
@@ -55,6 +53,17 @@ func backupCommand() {
 		log.Infof("Will clean up after backup...")
 	}
 
+	// Before a snapshot is created and held, which would have to be cleaned up again
+	if *preflight {
+		estimate, err := manager.EstimateSize(*subvolume, parentSnapshotName)
+		if err != nil {
+			log.Warnf("Skipping quota check, as the size of the backup could not be estimated: %v", err)
+		} else {
+			err = Abstractions.Preflight(backend, backupType, *subvolume, estimate)
+			Common.PrintAndExitOnError(err, 1)
+		}
+	}
+
 	currentSnapshot, err := manager.CreateSnapshot(*subvolume)
 	if err != nil {
 		log.Fatalln("Failed to create snapshot", err.Error())
@@ -68,21 +77,33 @@ func backupCommand() {
 	rc, err := manager.Stream(currentSnapshot, parentSnapshotName)
 	Common.PrintAndExitOnError(err, 1)
 
-	uploader := Abstractions.NewUploader(rc, backupType, *subvolume, *folder, currentSnapshot, *passphrase, *encryption, *authentication, *chunksize, *tmpdir)
+	uploader := Abstractions.NewUploader(rc, backend, backupType, *subvolume, currentSnapshot, snapshotKeys(), *encryption, *authentication, *chunksize, *tmpdir, *streaming, *uploads)
 	if latestUploaded != nil {
 		uploader.Parent = parentSnapshotUuid
 	}
 	meta, err := uploader.Upload()
 	Common.PrintAndExitOnError(err, 1)
 
-	fileId, err := GoogleDrive.SaveLatest(currentSnapshot, meta.Uuid, *subvolume, *folder)
+	err = backend.SetLatest(*subvolume, &Common.Snapshot{Uuid: meta.Uuid, Filename: currentSnapshot})
 	Common.PrintAndExitOnError(err, 1)
 
-	log.Infof("FileID of state: %s", fileId)
+	log.Infof("Latest snapshot of '%s' is now '%s'", *subvolume, currentSnapshot)
+
+	var mirrorErr error
+	if mirror, ok := backend.(*Abstractions.Mirror); ok {
+		mirrorErr = mirror.Report()
+	}
 
 	if *cleanup {
 		log.Infof("Cleaning up...")
 		manager.Cleanup(*subvolume, currentSnapshot)
-		GoogleDrive.Cleanup(folderId, *subvolume)
+		admin, err := adminBackend(backend)
+		if err != nil {
+			log.Errorf("Not cleaning up the backend: %v", err)
+		} else {
+			Abstractions.Cleanup(admin, *subvolume, *grace)
+		}
 	}
+
+	Common.PrintAndExitOnError(mirrorErr, 1)
 }
@@ -7,8 +7,8 @@ import (
 	"os"
 )
 
-func downloadCommand() {
-	uploader, err := Abstractions.NewDownloader(os.Stdout, *folder, *download, *passphrase, *tmpdir)
+func downloadCommand(backend Common.Backend) {
+	uploader, err := Abstractions.NewDownloader(os.Stdout, backend, *download, snapshotKeys(), *tmpdir, *streaming, *prefetch)
 	Common.PrintAndExitOnError(err, 1)
 	meta, err := uploader.Download()
 	log.Infoln(meta, err)
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"./Abstractions"
+	"./Common"
+	"github.com/prometheus/common/log"
+)
+
+// stretching returns the Argon2id parameters given by --argon2time, --argon2memory and
+// --argon2threads.
+func stretching() Common.Argon2 {
+	if *argon2Time > Common.ARGON2_MAX_TIME || *argon2Memory > Common.ARGON2_MAX_MEMORY || *argon2Threads > 255 {
+		log.Fatalf("--argon2time must be at most %d, --argon2memory at most %d KiB and --argon2threads at most 255", Common.ARGON2_MAX_TIME, Common.ARGON2_MAX_MEMORY)
+	}
+	stretching := Common.Argon2{Time: uint32(*argon2Time), Memory: uint32(*argon2Memory), Threads: uint8(*argon2Threads)}
+	if stretching.Validate() != nil {
+		log.Fatalln("--argon2time and --argon2threads must be at least 1, --argon2memory at least 8 KiB per thread")
+	}
+	return stretching
+}
+
+// snapshotKeys returns the keys given by --passphrase, --recipient and --identity.
+func snapshotKeys() *Common.Keys {
+	keys := &Common.Keys{Passphrase: *passphrase, Argon2: stretching()}
+
+	if *recipients != "" {
+		for _, recipient := range strings.Split(*recipients, ",") {
+			public, err := Common.ParsePublicKey(recipient)
+			if err != nil {
+				log.Fatalf("Invalid --recipient %q: %v", recipient, err)
+			}
+			keys.Recipients = append(keys.Recipients, public)
+		}
+	}
+
+	if *identity != "" {
+		identities, err := Common.ReadIdentityFile(*identity)
+		if err != nil {
+			log.Fatalf("Cannot read --identity %q: %v", *identity, err)
+		}
+		keys.Identities = identities
+	}
+
+	return keys
+}
+
+// keygenCommand writes a new private key to --keygen and prints its public key.
+func keygenCommand() {
+	if _, err := os.Stat(*keygen); err == nil {
+		log.Fatalf("%q already exists", *keygen)
+	}
+
+	secret, public, err := Common.GenerateKeyPair()
+	Common.PrintAndExitOnError(err, 1)
+
+	content := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n",
+		time.Now().Format(time.RFC3339), Common.EncodePublicKey(public), Common.EncodeSecretKey(secret))
+	err = ioutil.WriteFile(*keygen, []byte(content), 0600)
+	Common.PrintAndExitOnError(err, 1)
+
+	fmt.Println(Common.EncodePublicKey(public))
+}
+
+// newKeys returns the keys given by --newpassphrase and --newrecipient.
+func newKeys() *Common.Keys {
+	keys := &Common.Keys{Passphrase: *newPassphrase, Argon2: stretching()}
+	if *newRecipients != "" {
+		for _, recipient := range strings.Split(*newRecipients, ",") {
+			public, err := Common.ParsePublicKey(recipient)
+			if err != nil {
+				log.Fatalf("Invalid --newrecipient %q: %v", recipient, err)
+			}
+			keys.Recipients = append(keys.Recipients, public)
+		}
+	}
+	return keys
+}
+
+// listKeySlotsCommand prints the key slots of every snapshot of --subvolume, or of all
+// snapshots, and which of them --passphrase and --identity open.
+func listKeySlotsCommand(backend Common.Backend) {
+	keys := snapshotKeys()
+	err := Abstractions.ChangeKeySlots(backend, *subvolume, func(meta *Common.Metadata) (bool, error) {
+		fmt.Printf("'%s' (%s)\n", meta.FileName, meta.Uuid)
+		if len(meta.KeySlots) == 0 {
+			fmt.Println("\t- no key slots, keys are derived from the passphrase")
+		}
+		for i, opens := range keys.Opens(meta) {
+			opened := ""
+			if opens {
+				opened = " (opened by the given keys)"
+			}
+			fmt.Printf("\t- %d: %s%s\n", i, meta.KeySlots[i].Type, opened)
+		}
+		return false, nil
+	})
+	Common.PrintAndExitOnError(err, 1)
+}
+
+// addKeySlotCommand adds slots for --newpassphrase and --newrecipient to every snapshot of
+// --subvolume, or of all snapshots, that --passphrase or --identity unlock.
+func addKeySlotCommand(backend Common.Backend) {
+	add := newKeys()
+	if add.Passphrase == "" && len(add.Recipients) == 0 {
+		log.Fatalln("Must specify --newpassphrase or --newrecipient")
+	}
+	// Hidden metadata is sealed with a key derived from --passphrase, not with the data key.
+	// A new passphrase would not find the snapshots, and rotating would lock out the old one.
+	if *hideMetadata && add.Passphrase != "" {
+		log.Fatalln("--hidemetadata stays keyed with the passphrase it was set up with, so --newpassphrase cannot replace it. Use --newrecipient instead")
+	}
+
+	keys := snapshotKeys()
+	err := Abstractions.ChangeKeySlots(backend, *subvolume, func(meta *Common.Metadata) (bool, error) {
+		return true, keys.AddKeySlots(meta, add)
+	})
+	Common.PrintAndExitOnError(err, 1)
+}
+
+// removeKeySlotCommand removes the slots --passphrase and --identity open from every snapshot
+// of --subvolume, or of all snapshots.
+func removeKeySlotCommand(backend Common.Backend) {
+	keys := snapshotKeys()
+	if *hideMetadata && keys.Passphrase != "" {
+		log.Fatalln("--hidemetadata needs --passphrase, whose slots cannot be removed: the metadata stays keyed with it")
+	}
+	err := Abstractions.ChangeKeySlots(backend, *subvolume, func(meta *Common.Metadata) (bool, error) {
+		removed, err := keys.RemoveKeySlots(meta)
+		return removed > 0, err
+	})
+	Common.PrintAndExitOnError(err, 1)
+}
@@ -5,10 +5,11 @@ import (
 	"flag"
 	"os"
 	"runtime"
+	"time"
 
-	"./GoogleDrive"
+	"./Abstractions"
+	"./Common"
 	"fmt"
-	"github.com/hashicorp/vault/api"
 	"github.com/nightlyone/lockfile"
 	"github.com/prometheus/common/log"
 )
@@ -19,21 +20,63 @@ var (
 	chain          = flag.Bool("chain", false, "Display chain of snapshots to restore (can take some time for large datasets)")
 	download       = flag.String("download", "", "UUID to download to stdout")
 	authentication = flag.String("authentication", "HMAC-SHA3-512", "Define the authentication to use (NONE, HMAC-SHA[3-]{256,512})")
-	encryption     = flag.String("encryption", "AES-CTR", "Define the encryption to use (NONE, AES-{CTR,OFB,CFB})")
-	folder         = flag.String("folder", "", "Folder on Google Drive to backup to/from")
+	encryption     = flag.String("encryption", "AES-GCM", "Define the encryption to use (AES-GCM, CHACHA20-POLY1305, or without per block authentication NONE, AES-{CTR,OFB,CFB})")
+	backendName    = flag.String("backend", "googledrive", "Storage backend to backup to/from (googledrive, local, s3, sftp, webdav). Separate multiple backends with commas to mirror backups, optionally with their own folder: googledrive,local:/mnt/nas/backups")
+	folder         = flag.String("folder", "", "Folder on the backend to backup to/from (a directory for --backend local, sftp and webdav, a key prefix for --backend s3)")
+	s3Endpoint     = flag.String("s3endpoint", "s3.amazonaws.com", "S3 endpoint to connect to. Credentials are read from 'AWS_ACCESS_KEY_ID' and 'AWS_SECRET_ACCESS_KEY'")
+	s3Bucket       = flag.String("s3bucket", "", "S3 bucket to backup to/from")
+	s3Region       = flag.String("s3region", "", "S3 region of --s3bucket")
+	s3Insecure     = flag.Bool("s3insecure", false, "Connect to --s3endpoint via plain HTTP (e.g. a local MinIO)")
+	sftpHost       = flag.String("sftphost", "", "SFTP host[:port] to backup to/from")
+	sftpUser       = flag.String("sftpuser", "", "SFTP user. Default if empty: the current user")
+	sftpKey        = flag.String("sftpkey", "", "Private key to authenticate with. Keys of a running ssh-agent are used as well")
+	sftpKnownHosts = flag.String("sftpknownhosts", "", "known_hosts file to verify the host key against. Default if empty: ~/.ssh/known_hosts")
+	webdavURL      = flag.String("webdavurl", "", "WebDAV share to backup to/from, e.g. https://cloud.example.com/remote.php/dav/files/<user>/. The password is read from 'WEBDAV_PASSWORD'")
+	webdavUser     = flag.String("webdavuser", "", "WebDAV user")
+	appendOnly     = flag.Bool("appendonly", false, "This host only holds credentials that can add files. Anything that deletes or moves files on the backend (--cleanup, --restore-quarantined) uses the admin credentials below or is refused")
+	adminAccount   = flag.String("adminserviceaccount", "", "Service account key (JSON) allowed to delete from Google Drive, for --appendonly")
+	sftpAdminUser  = flag.String("sftpadminuser", "", "SFTP user allowed to delete, for --appendonly")
+	sftpAdminKey   = flag.String("sftpadminkey", "", "Private key of --sftpadminuser")
+	webdavAdmin    = flag.String("webdavadminuser", "", "WebDAV user allowed to delete, for --appendonly. The password is read from 'WEBDAV_ADMIN_PASSWORD'")
+	migrate        = flag.String("migrate", "", "Copy the chain of --subvolume from --backend to this backend (<backend>[:<folder>], e.g. s3:backups) without decrypting it. Run it again to resume, which also continues the Google Drive upload sessions of chunks that were cut off")
+	hideMetadata   = flag.Bool("hidemetadata", false, "Encrypt snapshot metadata and store subvolumes and filesystem types only as keyed hashes. Needs --passphrase for every command")
 	passphrase     = flag.String("passphrase", "", "Passphrase to use to en-/decrypt and for authentication")
-	quota          = flag.Bool("quota", false, "Define to see Google Drive quota used before continuing")
+	recipients     = flag.String("recipient", "", "Public keys (comma separated) to encrypt backups to instead of --passphrase. Restoring them needs --identity")
+	identity       = flag.String("identity", "", "File with private keys to restore backups that were encrypted to public keys")
+	keygen         = flag.String("keygen", "", "Write a new private key to this file and print its public key for --recipient")
+	listKeySlots   = flag.Bool("listkeyslots", false, "List the key slots of the snapshots of --subvolume (all snapshots if empty) and which of them --passphrase and --identity open")
+	addKeySlot     = flag.Bool("addkeyslot", false, "Add key slots for --newpassphrase and --newrecipient to the snapshots of --subvolume (all snapshots if empty) that --passphrase or --identity open. Only the metadata is rewritten")
+	removeKeySlot  = flag.Bool("removekeyslot", false, "Remove the key slots --passphrase and --identity open from the snapshots of --subvolume (all snapshots if empty). The last slot of a snapshot is never removed")
+	newPassphrase  = flag.String("newpassphrase", "", "Passphrase to add with --addkeyslot")
+	newRecipients  = flag.String("newrecipient", "", "Public keys (comma separated) to add with --addkeyslot")
+	argon2Time     = flag.Uint("argon2time", uint(Common.DefaultArgon2.Time), "Argon2id passes to stretch passphrases of new key slots with. Snapshots are restored with the parameters they were uploaded with")
+	argon2Memory   = flag.Uint("argon2memory", uint(Common.DefaultArgon2.Memory), "Argon2id memory in KiB to stretch passphrases of new key slots with")
+	argon2Threads  = flag.Uint("argon2threads", uint(Common.DefaultArgon2.Threads), "Argon2id threads to stretch passphrases of new key slots with")
+	quota          = flag.Bool("quota", false, "Define to see backend quota used before continuing")
+	preflight      = flag.Bool("preflight", true, "Estimate the size of a backup before creating its snapshot and abort if it clearly exceeds the remaining quota of the backend")
 	chunksize      = flag.Int("chunksize", 256, "Chunksize for files in MiB. Note: You need this space on disk/RAM during up- & download!")
-	backup         = flag.String("backup", "", "Specify 'btrfs' or 'zfs' to backup a snapshot")
+	retries        = flag.Int("retries", 10, "Attempts per chunk/metadata transfer before giving up. 0 retries until --retrytimeout. Errors that will not go away by themselves are never retried")
+	retryTimeout   = flag.Duration("retrytimeout", 0, "Give up retrying a transfer after this long, e.g. '2h'. 0 for no limit")
+	bwLimit        = flag.String("bwlimit", "", "Limit uploads to a rate per second, e.g. '5MiB', or a schedule like '08:00-20:00 2MiB,10MiB' (last rate applies at all other times, default unlimited)")
+	bwLimitDown    = flag.String("bwlimitdown", "", "Limit downloads, same format as --bwlimit")
+	uploads        = flag.Int("uploads", 1, "Number of chunks to upload at the same time. Each of them is staged in --tmpdir, so this needs --uploads times --chunksize of space")
+	prefetch       = flag.Uint("prefetch", 0, "Number of chunks to download ahead of the one being restored. Each of them is staged in --tmpdir, so this needs --prefetch+1 times --chunksize of space")
+	streaming      = flag.Bool("streaming", false, "Stream chunks to/from the backend instead of staging them in --tmpdir. A chunk that fails to upload aborts the backup. Not supported with multiple backends")
+	backup         = flag.String("backup", "", "Specify 'btrfs' or 'zfs' to backup a snapshot. An interrupted backup is not resumed, running it again uploads a new snapshot")
 	restore        = flag.String("restore", "", "Specify 'btrfs' or 'zfs' to restore a snapshot")
 	restoreTarget  = flag.String("restoretarget", "", "Specify a zfs/btrfs subvolume to restore to")
 	subvolume      = flag.String("subvolume", "", "Subvolume to backup/restore to (btrfs/zfs only)")
 	latest         = flag.Bool("latest", false, "Grab latest successfully uploaded snapshot for --subvolume")
+	serviceAccount = flag.String("serviceaccount", "", "Service account key (JSON) to access Google Drive with instead of a user token. Also read from 'serviceaccount.json' in Vault")
+	impersonate    = flag.String("impersonate", "", "User for the --serviceaccount to act as (needs domain-wide delegation)")
+	sharedDrive    = flag.String("shareddrive", "", "ID or name of a Google Shared Drive to backup to/from instead of My Drive")
 	vault          = flag.String("vault", "", "Vault URL to connect to (overrules 'VAULT_ADDR')")
 	vaultToken     = flag.String("vaulttoken", "", "Vault token to fetch Google Drive secrets with (overrules 'VAULT_TOKEN')")
 	tmpdir         = flag.String("tmpdir", "", "Temporary folder. Default if empty: /dev/shm (in-memory) or os.TempDir if unavailable")
 	full           = flag.Bool("full", false, "Force a full backup instead of doing an incemental one")
-	cleanup        = flag.Bool("cleanup", false, "Remove unneeded snapshots and delete inaddressable files from Google Drive at the end. If specified without --backup only Google Drive will be cleaned up")
+	cleanup        = flag.Bool("cleanup", false, "Remove unneeded snapshots and delete inaddressable files from the backend at the end. If specified without --backup only the backend will be cleaned up")
+	grace          = flag.Duration("grace", 30*24*time.Hour, "Files removed from the backend by --cleanup are quarantined for this long before a later --cleanup purges them. 0 deletes them right away")
+	unquarantine   = flag.String("restore-quarantined", "", "UUID of a quarantined snapshot to move back into --folder, or 'all'")
 )
 
 func main() {
@@ -50,24 +93,29 @@ func main() {
 		*vaultToken = vaultTokenEnv
 	}
 
-	if *vaultToken != "" {
-		log.Infoln("Using vault to access secrets...")
-		vaultConfig := api.Config{Address: *vault}
-		vaultClient, err := api.NewClient(&vaultConfig)
-		if err != nil {
-			log.Errorln(err)
-			// Try a regular Google Drive init as a fail-safe
-			GoogleDrive.InitGoogleDrive(nil)
-		}
-		vaultClient.SetToken(*vaultToken)
+	Common.DefaultRetry.Attempts = *retries
+	Common.DefaultRetry.Deadline = *retryTimeout
+
+	if *bwLimit != "" {
+		schedule, err := Common.ParseBandwidthSchedule(*bwLimit)
+		Common.PrintAndExitOnError(err, 1)
+		Common.UploadLimiter = Common.NewLimiter("Upload", schedule)
+	}
+	if *bwLimitDown != "" {
+		schedule, err := Common.ParseBandwidthSchedule(*bwLimitDown)
+		Common.PrintAndExitOnError(err, 1)
+		Common.DownloadLimiter = Common.NewLimiter("Download", schedule)
+	}
 
-		GoogleDrive.InitGoogleDrive(vaultClient)
-	} else {
-		GoogleDrive.InitGoogleDrive(nil)
+	if *keygen != "" {
+		keygenCommand()
+		os.Exit(0)
 	}
 
+	backend := openBackend()
+
 	if *quota {
-		GoogleDrive.DisplayQuota()
+		displayQuota(backend)
 	}
 
 	if *backup != "" {
@@ -88,29 +136,48 @@ func main() {
 
 	switch {
 	case *list:
-		parent := GoogleDrive.FindOrCreateFolder(*folder)
-		GoogleDrive.ListFiles(parent)
+		listFiles(backend)
 		os.Exit(0)
 	case *chain:
-		chainCommand()
+		chainCommand(backend)
 	case *backup != "":
-		backupCommand()
+		backupCommand(backend)
 	case *restore != "":
-		restoreCommand()
+		restoreCommand(backend)
 	case *download != "":
-		downloadCommand()
+		downloadCommand(backend)
 	case *upload != "":
-		uploadCommand()
+		uploadCommand(backend)
+	case *migrate != "":
+		migrateCommand(backend)
+	case *listKeySlots:
+		listKeySlotsCommand(backend)
+	case *addKeySlot:
+		admin, err := adminBackend(backend)
+		Common.PrintAndExitOnError(err, 1)
+		addKeySlotCommand(admin)
+	case *removeKeySlot:
+		admin, err := adminBackend(backend)
+		Common.PrintAndExitOnError(err, 1)
+		removeKeySlotCommand(admin)
+	case *unquarantine != "":
+		admin, err := adminBackend(backend)
+		Common.PrintAndExitOnError(err, 1)
+		err = Abstractions.RestoreQuarantined(admin, *unquarantine)
+		Common.PrintAndExitOnError(err, 1)
 	case *latest:
 		if *subvolume == "" {
 			log.Fatalln("Must specify --subvolume")
 		}
-		if *folder == "" {
-			log.Fatalln("Must specify --folder")
+		if !hasFolders() {
+			log.Fatalln("Must specify --folder, or a folder for every backend")
+		}
+		snapshot, err := backend.GetLatest(*subvolume)
+		Common.PrintAndExitOnError(err, 1)
+		if snapshot == nil {
+			log.Fatalln(Common.E_NO_LATEST)
 		}
-		parent := GoogleDrive.FindOrCreateFolder(*folder)
-		snapshot, err := GoogleDrive.FetchLatest(parent, *subvolume)
-		fmt.Println(snapshot, err)
+		fmt.Println(snapshot.Filename)
 	case *quota:
 		// NOOP
 	case *cleanup:
@@ -119,11 +186,12 @@ func main() {
 		if *subvolume == "" {
 			log.Fatalln("Must specify --subvolume")
 		}
-		if *folder == "" {
-			log.Fatalln("Must specify --folder")
+		if !hasFolders() {
+			log.Fatalln("Must specify --folder, or a folder for every backend")
 		}
-		parent := GoogleDrive.FindOrCreateFolder(*folder)
-		GoogleDrive.Cleanup(parent, *subvolume)
+		admin, err := adminBackend(backend)
+		Common.PrintAndExitOnError(err, 1)
+		Abstractions.Cleanup(admin, *subvolume, *grace)
 	default:
 		log.Fatalln("Please select an option")
 	}
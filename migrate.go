@@ -0,0 +1,20 @@
+package main
+
+import (
+	"./Abstractions"
+	"./Common"
+	"github.com/prometheus/common/log"
+)
+
+func migrateCommand(backend Common.Backend) {
+	if *subvolume == "" {
+		log.Fatalln("Must specify --subvolume")
+	}
+
+	target := openBackendSpec(*migrate)
+
+	err := Abstractions.Migrate(backend, target, *subvolume, *tmpdir)
+	Common.PrintAndExitOnError(err, 1)
+
+	log.Infof("Migrated '%s' to %s", *subvolume, *migrate)
+}
@@ -9,21 +9,19 @@ import (
 	"./Common"
 	"./Discard"
 	"./ZFS"
-	"./GoogleDrive"
 	"github.com/dustin/go-humanize"
 	"github.com/prometheus/common/log"
 )
 
-func chainCommand() {
+func chainCommand(backend Common.Backend) {
 	if *subvolume == "" {
 		log.Fatalln("Must specify --subvolume")
 	}
-	if *folder == "" {
-		log.Fatalln("Must specify --folder")
+	if !hasFolders() {
+		log.Fatalln("Must specify --folder, or a folder for every backend")
 	}
 
-	folderId := GoogleDrive.FindOrCreateFolder(*folder)
-	chain := GoogleDrive.BuildChain(folderId, *subvolume, true)
+	chain := Abstractions.BuildChain(backend, *subvolume, true)
 	printInfo(&chain)
 }
 
@@ -33,18 +31,26 @@ func printInfo (chain *[]Common.SnapshotWithSize) {
 	}
 	var sizeOnDisk uint64 = 0
 	var downloadSize uint64 = 0
+	unknownSize := 0
 	for _, snap := range *chain {
 		sizeOnDisk += snap.DiskSize
 		downloadSize += snap.DownloadSize
+		if snap.DiskSize == 0 && snap.DownloadSize != 0 {
+			unknownSize++
+		}
 	}
 
 	log.Infof("Subvolume: %s", *subvolume)
 	log.Infof("Snapshots %d", len(*chain))
-	log.Infof("Size on Disk: %s", humanize.IBytes(sizeOnDisk))
+	if unknownSize != 0 {
+		log.Infof("Size on Disk: %s (unknown for %d older snapshots)", humanize.IBytes(sizeOnDisk), unknownSize)
+	} else {
+		log.Infof("Size on Disk: %s", humanize.IBytes(sizeOnDisk))
+	}
 	log.Infof("Size to Download: %s", humanize.IBytes(downloadSize))
 }
 
-func restoreCommand() {
+func restoreCommand(backend Common.Backend) {
 	if *subvolume == "" {
 		log.Fatalln("Must specify --subvolume")
 	}
@@ -75,19 +81,19 @@ func restoreCommand() {
 	var previous string
 
 	log.Info("Building restore chain. This might take a while...")
-	folderId := GoogleDrive.FindOrCreateFolder(*folder)
-	restoreChain := GoogleDrive.BuildChain(folderId, *subvolume, true)
+	restoreChain := Abstractions.BuildChain(backend, *subvolume, true)
 	printInfo(&restoreChain)
 	log.Info("starting restore...")
 
 	for _, snap := range restoreChain {
 		wp := &Abstractions.WriteProxy{}
-		downloader, err := Abstractions.NewDownloader(wp, *folder, snap.Uuid, *passphrase, *tmpdir)
+		downloader, err := Abstractions.NewDownloader(wp, backend, snap.Uuid, snapshotKeys(), *tmpdir, *streaming, *prefetch)
 		if err != nil {
 			if err == Abstractions.E_NO_DATA {
 				log.Infoln("Snapshot has no data, skipping...")
 				continue
 			}
+			Common.PrintAndExitOnError(err, 1)
 		}
 		wc, err := manager.Restore(*restoreTarget)
 		Common.PrintAndExitOnError(err, 1)
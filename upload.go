@@ -2,12 +2,13 @@ package main
 
 import (
 	"./Abstractions"
+	"./Common"
 	"github.com/prometheus/common/log"
 	"os"
 )
 
-func uploadCommand() {
-	uploader := Abstractions.NewUploader(os.Stdin, "btrfs", "/", *folder, *upload, *passphrase, *encryption, *authentication, *chunksize, *tmpdir)
+func uploadCommand(backend Common.Backend) {
+	uploader := Abstractions.NewUploader(os.Stdin, backend, "btrfs", "/", *upload, snapshotKeys(), *encryption, *authentication, *chunksize, *tmpdir, *streaming, *uploads)
 	meta, err := uploader.Upload()
 	log.Infoln(meta, err)
 }